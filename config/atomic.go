@@ -0,0 +1,193 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// AtomicFile is a file that is written under a temporary name in the
+// directory of its final name, and replaces the file with the final
+// name when it is committed.  A command that is interrupted therefore
+// leaves either the old or the new contents of the file in place,
+// never a partly written file.
+type AtomicFile struct {
+	*os.File
+	name string
+	done bool
+}
+
+// CreateAtomic creates a temporary file that replaces the file name
+// when it is committed.  Abort should be deferred, so that the
+// temporary file is removed if the file is not committed.
+func CreateAtomic(name string) (*AtomicFile, error) {
+
+	d, f := path.Split(name)
+	fid, err := ioutil.TempFile(d, "."+f+".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	// TempFile creates the file with mode 0600
+	if err := fid.Chmod(0644); err != nil {
+		fid.Close()
+		os.Remove(fid.Name())
+		return nil, err
+	}
+
+	return &AtomicFile{File: fid, name: name}, nil
+}
+
+// Commit flushes the file to disk, closes it, and moves it to its
+// final name.
+func (f *AtomicFile) Commit() error {
+
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.File.Name(), f.name); err != nil {
+		return err
+	}
+	f.done = true
+
+	return nil
+}
+
+// Abort closes and removes the file if it has not been committed.
+func (f *AtomicFile) Abort() {
+	if !f.done {
+		f.File.Close()
+		os.Remove(f.File.Name())
+		f.done = true
+	}
+}
+
+// IsTempFile returns true if the file name is that of a temporary
+// file created by CreateAtomic, which is left behind if a command is
+// killed.
+func IsTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp")
+}
+
+// WriteJSON atomically replaces the file fname with the json encoding
+// of v.
+func WriteJSON(fname string, v interface{}) {
+
+	fid, err := CreateAtomic(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Abort()
+
+	enc := json.NewEncoder(fid)
+	err = enc.Encode(v)
+	if err != nil {
+		panic(err)
+	}
+
+	err = fid.Commit()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Pending describes an operation on a bucket that rewrites several of
+// its column files.  It is recorded in the bucket directory while the
+// operation runs.  If the operation does not finish, the bucket can
+// be restored to its state before the operation from the copies of
+// the column files in the Backup directory, using the recover tool.
+type Pending struct {
+
+	// The command performing the operation
+	Command string
+
+	// The directory within the bucket directory holding the
+	// original column files
+	Backup string
+
+	Start time.Time
+}
+
+func pendingFile(dir string) string {
+	return path.Join(dir, "pending.json")
+}
+
+// StartPending records that an operation is starting in a bucket
+// directory, and creates its empty backup directory.  It panics if
+// another operation has not finished.
+func StartPending(dir, command, backup string) {
+
+	if p := ReadPending(dir); p != nil {
+		msg := "%s in %s did not finish, run the recover tool before running %s\n"
+		panic(fmt.Sprintf(msg, p.Command, dir, command))
+	}
+
+	bdir := path.Join(dir, backup)
+	err := os.RemoveAll(bdir)
+	if err != nil {
+		panic(err)
+	}
+	err = os.MkdirAll(bdir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	WriteJSON(pendingFile(dir), &Pending{Command: command, Backup: backup, Start: time.Now()})
+}
+
+// FinishPending records that the operation in a bucket directory has
+// finished.
+func FinishPending(dir string) {
+	err := os.Remove(pendingFile(dir))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ReadPending returns the unfinished operation in a bucket directory,
+// or nil if there is none.
+func ReadPending(dir string) *Pending {
+
+	fid, err := os.Open(pendingFile(dir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	p := new(Pending)
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(p)
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+// Backup saves a copy of a column file in the backup directory of
+// the pending operation in the bucket directory, before the file is
+// replaced.  The copy is a hard link, so no data are copied.
+func Backup(fname, backup string) {
+
+	d, f := path.Split(fname)
+	bname := path.Join(d, backup, f)
+
+	// A column is only backed up once per operation.
+	if _, err := os.Stat(bname); err == nil {
+		return
+	}
+
+	err := os.Link(fname, bname)
+	if err != nil {
+		panic(err)
+	}
+}
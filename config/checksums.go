@@ -0,0 +1,103 @@
+package config
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+var (
+	// Checksums are CRC32C values of the decompressed file contents.
+	crctable = crc32.MakeTable(crc32.Castagnoli)
+
+	// Serializes updates to the checksum files within a process.
+	crcmut sync.Mutex
+)
+
+// ChecksumWriter passes data through to W, updating Sum with the
+// CRC32C checksum of the data.  Sum can be initialized with the
+// checksum of data that was previously written to the same file.
+type ChecksumWriter struct {
+	W   io.Writer
+	Sum uint32
+}
+
+func (cw *ChecksumWriter) Write(p []byte) (int, error) {
+	cw.Sum = crc32.Update(cw.Sum, crctable, p)
+	return cw.W.Write(p)
+}
+
+// FileChecksum returns the CRC32C checksum of the decompressed
+// contents of a column file.
+func FileChecksum(fname string) (uint32, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer fid.Close()
+
+	h := crc32.New(crctable)
+	_, err = io.Copy(h, snappy.NewReader(fid))
+	if err != nil {
+		return 0, err
+	}
+
+	return h.Sum32(), nil
+}
+
+// ReadChecksums returns the checksums recorded for the column files
+// in a bucket directory, as a map from file names to checksums.
+func ReadChecksums(dir string) map[string]uint32 {
+
+	sums := make(map[string]uint32)
+
+	fid, err := os.Open(path.Join(dir, "checksums.json"))
+	if os.IsNotExist(err) {
+		return sums
+	} else if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(&sums)
+	if err != nil {
+		panic(err)
+	}
+
+	return sums
+}
+
+// SetChecksums records checksums for the given column files in a
+// bucket directory.  The checksums of other files in the directory
+// are not changed.
+func SetChecksums(dir string, sums map[string]uint32) {
+
+	crcmut.Lock()
+	defer crcmut.Unlock()
+
+	all := ReadChecksums(dir)
+	for fn, s := range sums {
+		all[fn] = s
+	}
+
+	WriteJSON(path.Join(dir, "checksums.json"), all)
+}
+
+// UpdateChecksum recomputes and records the checksum of one column
+// file, for use when a file is restored from a backup.
+func UpdateChecksum(fname string) {
+
+	s, err := FileChecksum(fname)
+	if err != nil {
+		panic(err)
+	}
+
+	d, f := path.Split(fname)
+	SetChecksums(d, map[string]uint32{f: s})
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+)
+
+// CodeGroup describes how a variable was factorized.
+type CodeGroup struct {
+
+	// The prefix of the code group, the codes are in
+	// {Prefix}Codes.json in CodesDir
+	Prefix string
+
+	// The names of the normalizers that were applied to the
+	// values before they were coded, in the order applied
+	Normalize []string `json:",omitempty"`
+
+	// The options used to collapse rare values into a single
+	// code, if any
+	MinFreq uint64 `json:",omitempty"`
+	TopK    int    `json:",omitempty"`
+}
+
+// ReadCodeGroupFile reads a CodeGroups.json file, returning a map
+// from the names of factorized variables to their code groups.  In
+// the file, variables that were not normalized and have no collapsed
+// values have only their prefix, as in earlier versions of the file.  The map is empty if
+// the file does not exist.
+func ReadCodeGroupFile(fname string) map[string]*CodeGroup {
+
+	mp := make(map[string]*CodeGroup)
+
+	fid, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return mp
+	} else if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	raw := make(map[string]json.RawMessage)
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(&raw)
+	if err != nil {
+		panic(err)
+	}
+
+	for vn, r := range raw {
+		cg := new(CodeGroup)
+		if len(r) > 0 && r[0] == '"' {
+			err = json.Unmarshal(r, &cg.Prefix)
+		} else {
+			err = json.Unmarshal(r, cg)
+		}
+		if err != nil {
+			panic(err)
+		}
+		mp[vn] = cg
+	}
+
+	return mp
+}
+
+// WriteCodeGroupFile writes the code groups of the factorized
+// variables to a CodeGroups.json file.
+func WriteCodeGroupFile(fname string, groups map[string]*CodeGroup) {
+
+	mp := make(map[string]interface{})
+	for vn, cg := range groups {
+		if len(cg.Normalize) == 0 && cg.MinFreq == 0 && cg.TopK == 0 {
+			mp[vn] = cg.Prefix
+		} else {
+			mp[vn] = cg
+		}
+	}
+
+	WriteJSON(fname, mp)
+}
+
+// ReadCodeGroupInfo returns a map from the names of the factorized
+// variables in a dataset to their code groups.
+func ReadCodeGroupInfo(conf *Config) map[string]*CodeGroup {
+	return ReadCodeGroupFile(path.Join(conf.TargetDir, "CodeGroups.json"))
+}
+
+// ReadCodeGroups returns a map from the names of factorized variables
+// to the prefix of their code group.  The map is empty if nothing
+// has been factorized.
+func ReadCodeGroups(conf *Config) map[string]string {
+
+	mp := make(map[string]string)
+	for vn, cg := range ReadCodeGroupInfo(conf) {
+		mp[vn] = cg.Prefix
+	}
+
+	return mp
+}
@@ -6,8 +6,10 @@ routines that are shared among the packages in this project.
 package config
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/adler32"
 	"io/ioutil"
 	"os"
 	"path"
@@ -36,20 +38,45 @@ type Config struct {
 	// Split the data into this number of buckets
 	NumBuckets uint32
 
+	// The hash function applied to the key variable to assign
+	// rows to buckets, either "adler32" (the default) or "fnv".
+	Hash string
+
 	// Store this number of buckets in memory before writing to disk
 	BufMaxRecs uint64
 
+	// The approximate number of bytes of data held in memory by
+	// all the buckets together.  When this is exceeded, the
+	// buckets holding the most data are written to disk.  If
+	// zero, only BufMaxRecs is used.
+	MemoryBudget uint64
+
 	// Number of SAS chunks processed in parallel
 	Concurrency int
 
+	// Number of goroutines that write the buckets to disk, each
+	// handling a subset of the buckets.  Defaults to Concurrency,
+	// but no more than NumBuckets.
+	Writers int
+
+	// Number of batches of records that can be queued for each
+	// writer before the SAS readers wait.  Defaults to 4.
+	WriterQueue int
+
 	// Process only this number of chunks.  If zero, all the
 	// chunks are processed.
 	MaxChunk uint32
+
+	// If true, sastocols places the data from SASFiles in a
+	// staging area under TargetDir, to be merged into the
+	// existing buckets, rather than replacing the dataset.
+	Append bool
 }
 
 var (
 	// Size in bytes of each data type.
-	DTsize = map[string]int{"uint8": 1, "uint16": 2, "uint32": 4, "uint64": 8, "float32": 4, "float64": 8}
+	DTsize = map[string]int{"uint8": 1, "uint16": 2, "uint32": 4, "uint64": 8, "int32": 4, "int64": 8,
+		"float32": 4, "float64": 8, "date": 4, "datetime": 8}
 )
 
 // ReadConfig returns the configuration information stored at the
@@ -81,6 +108,24 @@ func ReadConfig(filename string) *Config {
 		config.Concurrency = 10
 	}
 
+	if config.Writers == 0 {
+		config.Writers = config.Concurrency
+	}
+	if config.NumBuckets > 0 && config.Writers > int(config.NumBuckets) {
+		config.Writers = int(config.NumBuckets)
+	}
+	if config.WriterQueue == 0 {
+		config.WriterQueue = 4
+	}
+
+	if config.Hash == "" {
+		config.Hash = "adler32"
+	}
+	if config.Hash != "adler32" && config.Hash != "fnv" {
+		msg := fmt.Sprintf("Unknown hash function %s in %s\n", config.Hash, filename)
+		panic(msg)
+	}
+
 	return config
 }
 
@@ -90,6 +135,38 @@ func BucketPath(bucket int, conf *Config) string {
 	return path.Join(conf.TargetDir, "Buckets", b)
 }
 
+// Bucket returns the bucket that holds the rows with the given value
+// of the key variable.
+func Bucket(key uint64, conf *Config) int {
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], key)
+
+	var h uint32
+	switch conf.Hash {
+	case "", "adler32":
+		h = adler32.Checksum(buf[:])
+	case "fnv":
+		// 32 bit FNV-1a
+		h = 2166136261
+		for _, b := range buf {
+			h ^= uint32(b)
+			h *= 16777619
+		}
+	default:
+		panic("unknown hash function " + conf.Hash)
+	}
+
+	return int(h % conf.NumBuckets)
+}
+
+// StagePath returns the path to the staging area for the given
+// bucket, used when appending data to an existing dataset.
+func StagePath(bucket int, conf *Config) string {
+	b := fmt.Sprintf("%04d", bucket)
+	return path.Join(conf.TargetDir, "Append", b)
+}
+
 // ReadDtypes returns a map describing the column data types map for a
 // given bucket.  The dtypes map associates variable names with their
 // data type (e.g. uint8).
@@ -114,6 +191,31 @@ func ReadDtypes(bucket int, conf *Config) map[string]string {
 	return dtypes
 }
 
+// CheckAppendDtypes returns an error if data with dtypes newtypes
+// cannot be appended to data with dtypes oldtypes.  The variables
+// must be the same and have the same dtypes, except that string
+// variables can be appended to factorized (uvarint) variables.
+func CheckAppendDtypes(oldtypes, newtypes map[string]string) error {
+
+	if len(oldtypes) != len(newtypes) {
+		return fmt.Errorf("existing data have %d variables, new data have %d variables",
+			len(oldtypes), len(newtypes))
+	}
+
+	for vn, nt := range newtypes {
+		ot, ok := oldtypes[vn]
+		if !ok {
+			return fmt.Errorf("variable %s is not in the existing data", vn)
+		}
+		if ot == nt || (ot == "uvarint" && nt == "string") {
+			continue
+		}
+		return fmt.Errorf("variable %s has dtype %s, existing data have dtype %s", vn, nt, ot)
+	}
+
+	return nil
+}
+
 // VarDesc is a description of a variable to be ported from a SAS
 // file.  Name, GoType, and SASType must be provided, and Must is
 // optional.
@@ -141,12 +243,53 @@ type VarDesc struct {
 	// SAS files.
 	KeyVar bool
 
+	// For derived variables, an expression giving the value of
+	// the variable in terms of other variables.
+	Expr string
+
+	// For date or datetime variables with SAS type string, the
+	// layout of the dates, as in time.Parse.
+	DateFormat string
+
+	// How values that are out of range for GoType are handled:
+	// "clamp" (the default) stores the nearest value in range
+	// (for dates and datetimes, the smallest value in range is
+	// one more than MissingDate or MissingDatetime),
+	// "missing" stores zero (NaN for floating point types, and
+	// MissingDate or MissingDatetime for dates and datetimes), and
+	// "error" stops the conversion.
+	Overflow string
+
 	SASName  string // used internally
 	SASTypeU string // used internally
+	GoStore  string // used internally
+	CastSrc  string // used internally
+}
+
+// VarDefs is the contents of a variable definition file.
+type VarDefs struct {
+
+	// Descriptions of the variables
+	Variable []*VarDesc
+
+	// Descriptions of variables that are computed from other
+	// variables, rather than read from the SAS files
+	Derived []*VarDesc
+
+	// An optional expression in terms of the variables.  Rows for
+	// which the expression is false are not converted.  See
+	// TranslateExpr for the expression syntax.
+	Filter string
 }
 
 // Read a json file containing the variable information.
 func GetVarDefs(filename string) []*VarDesc {
+	return ReadVarDefs(filename).Variable
+}
+
+// ReadVarDefs reads a toml file containing the variable information
+// and other directives for converting the SAS files.
+func ReadVarDefs(filename string) *VarDefs {
 
 	fid, err := os.Open(filename)
 	if err != nil {
@@ -158,12 +301,8 @@ func GetVarDefs(filename string) []*VarDesc {
 	}
 	fid.Close()
 
-	type vdesct struct {
-		Variable []*VarDesc
-	}
-
-	var vdesca vdesct
-	_, err = toml.Decode(string(s), &vdesca)
+	vdesca := new(VarDefs)
+	_, err = toml.Decode(string(s), vdesca)
 	if err != nil {
 		panic(err)
 	}
@@ -175,7 +314,52 @@ func GetVarDefs(filename string) []*VarDesc {
 		if v.Type == "" {
 			v.Type = v.GoType
 		}
+		setGoStore(v)
+		setOverflow(v)
+
+		if v.SASType == "string" && v.DateFormat == "" {
+			switch v.GoType {
+			case "date":
+				v.DateFormat = "2006-01-02"
+			case "datetime":
+				v.DateFormat = "2006-01-02 15:04:05"
+			}
+		}
+	}
+
+	for _, v := range vdesca.Derived {
+		if v.Type == "" {
+			v.Type = v.GoType
+		}
+		setGoStore(v)
+		setOverflow(v)
 	}
 
-	return vdesca.Variable
+	return vdesca
+}
+
+// setGoStore sets the Go type that holds the values of a variable in
+// memory.  Dates and datetimes are held as integers.
+func setGoStore(v *VarDesc) {
+	switch v.GoType {
+	case "date":
+		v.GoStore = "int32"
+	case "datetime":
+		v.GoStore = "int64"
+	default:
+		v.GoStore = v.GoType
+	}
+}
+
+// setOverflow checks the overflow policy of a variable, using the
+// default policy if none is given.
+func setOverflow(v *VarDesc) {
+	switch v.Overflow {
+	case "":
+		v.Overflow = "clamp"
+	case "clamp", "missing", "error":
+	default:
+		msg := fmt.Sprintf("Variable %s has unknown overflow policy %s\n", v.Name, v.Overflow)
+		panic(msg)
+	}
 }
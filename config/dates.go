@@ -0,0 +1,113 @@
+package config
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// Variables with dtype date are stored as int32 values, giving the
+// number of days since 1970-01-01.  Variables with dtype datetime are
+// stored as int64 values, giving the number of seconds since
+// 1970-01-01 00:00:00 UTC.  SAS dates are days since 1960-01-01, and
+// SAS datetimes are seconds since 1960-01-01 00:00:00.  Missing
+// values are stored as MissingDate and MissingDatetime, since zero is
+// the valid date 1970-01-01.
+const (
+	// The stored value of a missing date
+	MissingDate int32 = math.MinInt32
+
+	// The stored value of a missing datetime
+	MissingDatetime int64 = math.MinInt64
+
+	// Days from 1960-01-01 to 1970-01-01
+	SASDateOffset = 3653
+
+	// Seconds from 1960-01-01 to 1970-01-01
+	SASDatetimeOffset = 3653 * 86400
+)
+
+// DateToTime converts a date value to a time.Time (midnight UTC).
+func DateToTime(d int32) time.Time {
+	return time.Unix(int64(d)*86400, 0).UTC()
+}
+
+// DatetimeToTime converts a datetime value to a time.Time in UTC.
+func DatetimeToTime(s int64) time.Time {
+	return time.Unix(s, 0).UTC()
+}
+
+// SASDate converts a date value to a SAS date, which is NaN if the
+// date is missing.
+func SASDate(d int32) float64 {
+	if d == MissingDate {
+		return math.NaN()
+	}
+	return float64(d) + SASDateOffset
+}
+
+// SASDatetime converts a datetime value to a SAS datetime, which is
+// NaN if the datetime is missing.
+func SASDatetime(s int64) float64 {
+	if s == MissingDatetime {
+		return math.NaN()
+	}
+	return float64(s) + SASDatetimeOffset
+}
+
+// TimeToDate converts a time.Time to a date value.
+func TimeToDate(t time.Time) int32 {
+	return int32(math.Floor(float64(t.Unix()) / 86400))
+}
+
+// TimeToDatetime converts a time.Time to a datetime value.
+func TimeToDatetime(t time.Time) int64 {
+	return t.Unix()
+}
+
+// ReadTimes returns the values of a date or datetime variable in the
+// given bucket.  Missing values are returned as the zero time.Time,
+// for which IsZero is true.
+func ReadTimes(bucket int, conf *Config, vname string) []time.Time {
+
+	dt := ReadDtypes(bucket, conf)[vname]
+	if dt != "date" && dt != "datetime" {
+		msg := fmt.Sprintf("Variable %s has dtype %s, not date or datetime\n", vname, dt)
+		panic(msg)
+	}
+
+	fn := path.Join(BucketPath(bucket, conf), vname+".bin.sz")
+	fid, err := os.Open(fn)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	b, err := ioutil.ReadAll(snappy.NewReader(fid))
+	if err != nil {
+		panic(err)
+	}
+
+	w := DTsize[dt]
+	x := make([]time.Time, len(b)/w)
+	for i := range x {
+		if dt == "date" {
+			d := int32(binary.LittleEndian.Uint32(b[w*i : w*i+w]))
+			if d != MissingDate {
+				x[i] = DateToTime(d)
+			}
+		} else {
+			s := int64(binary.LittleEndian.Uint64(b[w*i : w*i+w]))
+			if s != MissingDatetime {
+				x[i] = DatetimeToTime(s)
+			}
+		}
+	}
+
+	return x
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// ExprFuncs maps the names of the built-in functions that can be
+// used in expressions to the names of the functions that implement
+// them in the generated sastocols code.
+var ExprFuncs = map[string]string{
+	"sasdate": "fn_sasdate",
+	"year":    "fn_year",
+	"month":   "fn_month",
+	"age":     "fn_age",
+	"concat":  "fn_concat",
+	"str":     "fn_str",
+}
+
+// TranslateExpr checks an expression that refers to the variables
+// described in vdefs, and returns equivalent Go source code in which
+// each variable is a field of the struct named recvar.  Expressions
+// use Go syntax, and may contain literals, variable names (not case
+// sensitive), comparison, arithmetic and boolean operators,
+// parentheses, and calls to the functions in ExprFuncs.  Numeric
+// variables are converted to float64, so that variables of
+// different types can be combined.  Date and datetime variables are
+// converted to SAS dates and datetimes, so that they can be used in
+// the same way as SAS date values that have not been converted, with
+// missing dates and datetimes converted to NaN.  Set
+// membership is written in(x, a, b, ...), which is true if x is
+// equal to any of a, b, ....
+func TranslateExpr(expr, recvar string, vdefs []*VarDesc) (string, error) {
+
+	e, err := parser.ParseExpr(expr)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse expression '%s': %v", expr, err)
+	}
+
+	names := make(map[string]*VarDesc)
+	for _, v := range vdefs {
+		names[strings.ToUpper(v.Name)] = v
+	}
+
+	tr := &translator{recvar: recvar, names: names}
+	s, err := tr.translate(e)
+	if err != nil {
+		return "", fmt.Errorf("in expression '%s': %v", expr, err)
+	}
+
+	return s, nil
+}
+
+type translator struct {
+	recvar string
+
+	// Maps upper-cased variable names to variable descriptions
+	names map[string]*VarDesc
+}
+
+// Binary operators allowed in expressions
+var exprops = map[token.Token]bool{
+	token.ADD: true, token.SUB: true, token.MUL: true, token.QUO: true,
+	token.EQL: true, token.NEQ: true, token.LSS: true, token.LEQ: true, token.GTR: true, token.GEQ: true,
+	token.LAND: true, token.LOR: true,
+}
+
+func (tr *translator) translate(e ast.Expr) (string, error) {
+
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		return e.Value, nil
+	case *ast.Ident:
+		if e.Name == "true" || e.Name == "false" {
+			return e.Name, nil
+		}
+		v, ok := tr.names[strings.ToUpper(e.Name)]
+		if !ok {
+			return "", fmt.Errorf("unknown variable %s", e.Name)
+		}
+		x := tr.recvar + "." + v.Name
+		switch v.GoType {
+		case "string":
+			return x, nil
+		case "date":
+			return "config.SASDate(" + x + ")", nil
+		case "datetime":
+			return "config.SASDatetime(" + x + ")", nil
+		}
+		return "float64(" + x + ")", nil
+	case *ast.ParenExpr:
+		x, err := tr.translate(e.X)
+		if err != nil {
+			return "", err
+		}
+		return "(" + x + ")", nil
+	case *ast.UnaryExpr:
+		if e.Op != token.NOT && e.Op != token.SUB {
+			return "", fmt.Errorf("operator %s not allowed", e.Op)
+		}
+		x, err := tr.translate(e.X)
+		if err != nil {
+			return "", err
+		}
+		return e.Op.String() + x, nil
+	case *ast.BinaryExpr:
+		if !exprops[e.Op] {
+			return "", fmt.Errorf("operator %s not allowed", e.Op)
+		}
+		x, err := tr.translate(e.X)
+		if err != nil {
+			return "", err
+		}
+		y, err := tr.translate(e.Y)
+		if err != nil {
+			return "", err
+		}
+		return x + " " + e.Op.String() + " " + y, nil
+	case *ast.CallExpr:
+		return tr.call(e)
+	}
+
+	return "", fmt.Errorf("unsupported expression at position %d", e.Pos())
+}
+
+// call translates function calls.
+func (tr *translator) call(e *ast.CallExpr) (string, error) {
+
+	fn, ok := e.Fun.(*ast.Ident)
+	if !ok {
+		return "", fmt.Errorf("unsupported function call at position %d", e.Pos())
+	}
+
+	var args []string
+	for _, a := range e.Args {
+		x, err := tr.translate(a)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, x)
+	}
+
+	switch fn.Name {
+	case "in":
+		if len(args) < 2 {
+			return "", fmt.Errorf("in requires at least two arguments")
+		}
+		var terms []string
+		for _, a := range args[1:] {
+			terms = append(terms, args[0]+" == "+a)
+		}
+		return "(" + strings.Join(terms, " || ") + ")", nil
+	}
+
+	gf, ok := ExprFuncs[fn.Name]
+	if !ok {
+		return "", fmt.Errorf("unknown function %s", fn.Name)
+	}
+
+	return gf + "(" + strings.Join(args, ", ") + ")", nil
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"math"
+	"math/bits"
+)
+
+const (
+	// The number of bits of the hash used to select a register.
+	// The standard error of the estimates is about 1.04 / 2^(p/2),
+	// or just under 1%.
+	hllPrecision = 14
+)
+
+// HLL is a HyperLogLog sketch, used to estimate the number of
+// distinct values in a collection without storing the values.
+type HLL struct {
+	reg []uint8
+}
+
+// NewHLL returns an empty sketch.
+func NewHLL() *HLL {
+	return &HLL{reg: make([]uint8, 1<<hllPrecision)}
+}
+
+// mix64 scrambles the bits of x (the splitmix64 finalizer), so that
+// the high and low bits of the hash are equally well distributed.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Add adds a value, given as a 64 bit hash, to the sketch.
+func (h *HLL) Add(x uint64) {
+
+	x = mix64(x)
+	j := x >> (64 - hllPrecision)
+
+	// The sentinel bit bounds the number of leading zeros.
+	w := x<<hllPrecision | 1<<(hllPrecision-1)
+	rho := uint8(bits.LeadingZeros64(w)) + 1
+
+	if rho > h.reg[j] {
+		h.reg[j] = rho
+	}
+}
+
+// AddString adds a string value to the sketch.
+func (h *HLL) AddString(s string) {
+
+	// 64 bit FNV-1a
+	var x uint64 = 14695981039346656037
+	for i := 0; i < len(s); i++ {
+		x ^= uint64(s[i])
+		x *= 1099511628211
+	}
+
+	h.Add(x)
+}
+
+// Merge adds the values in another sketch to h.
+func (h *HLL) Merge(o *HLL) {
+	for j, r := range o.reg {
+		if r > h.reg[j] {
+			h.reg[j] = r
+		}
+	}
+}
+
+// Estimate returns the estimated number of distinct values that have
+// been added to the sketch.
+func (h *HLL) Estimate() int64 {
+
+	m := float64(len(h.reg))
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	var sum float64
+	var zeros int
+	for _, r := range h.reg {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	e := alpha * m * m / sum
+
+	// Use linear counting for small cardinalities.
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+
+	return int64(e + 0.5)
+}
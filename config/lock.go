@@ -0,0 +1,181 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// LockInfo describes the command holding the lock on a dataset.
+type LockInfo struct {
+	Host    string
+	Pid     int
+	Command string
+	Start   time.Time
+}
+
+func (li *LockInfo) String() string {
+	return fmt.Sprintf("%s (pid %d on %s, started %s)", li.Command, li.Pid, li.Host,
+		li.Start.Format(time.RFC1123))
+}
+
+// LockError is returned by Lock when another command holds the lock.
+type LockError struct {
+	Dir    string
+	Holder *LockInfo
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("The dataset in %s is locked by %s.\nIf that command is no longer running, remove %s.",
+		e.Dir, e.Holder, lockFile(e.Dir))
+}
+
+func lockFile(dir string) string {
+	return path.Join(dir, ".lock")
+}
+
+// readLock returns the holder of the lock in dir, or nil if the lock
+// is not held.
+func readLock(dir string) *LockInfo {
+
+	b, err := ioutil.ReadFile(lockFile(dir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+
+	// A lock file that is being written may be empty or
+	// incomplete.
+	li := new(LockInfo)
+	if err := json.Unmarshal(b, li); err != nil {
+		li.Command = "an unknown command"
+	}
+
+	return li
+}
+
+// stale returns true if the lock holder was started on this host and
+// is no longer running.
+func (li *LockInfo) stale() bool {
+
+	host, err := os.Hostname()
+	if err != nil || host != li.Host || li.Pid <= 0 {
+		return false
+	}
+
+	err = syscall.Kill(li.Pid, 0)
+	return err == syscall.ESRCH
+}
+
+// same returns true if li and other describe the same holder.
+func (li *LockInfo) same(other *LockInfo) bool {
+	return li.Host == other.Host && li.Pid == other.Pid &&
+		li.Command == other.Command && li.Start.Equal(other.Start)
+}
+
+// takeover removes the lock in dir if it is still held by the stale
+// holder.  Commands that find the same stale lock take turns using
+// flock on a separate file, which is left in place, so that the lock
+// acquired by one of them after the stale lock is removed is not
+// removed by another.
+func takeover(dir string, stale *LockInfo) {
+
+	fid, err := os.OpenFile(lockFile(dir)+".takeover", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	err = syscall.Flock(int(fid.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		panic(err)
+	}
+	defer syscall.Flock(int(fid.Fd()), syscall.LOCK_UN)
+
+	holder := readLock(dir)
+	if holder == nil || !holder.same(stale) {
+		// Already taken over
+		return
+	}
+
+	os.Stderr.WriteString(fmt.Sprintf("Removing the lock held by %s, which is no longer running\n", holder))
+	err = os.Remove(lockFile(dir))
+	if err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+}
+
+// Lock acquires an advisory lock on the dataset in TargetDir, so that
+// commands that modify a dataset do not run at the same time.  The
+// lock is a file in TargetDir that describes the command holding it.
+// If the lock is held by another command, a *LockError describing it
+// is returned.  A lock left behind by a command that exited on this
+// host without releasing it is removed.
+func Lock(conf *Config, command string) error {
+
+	dir := conf.TargetDir
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	host, _ := os.Hostname()
+	li := &LockInfo{
+		Host:    host,
+		Pid:     os.Getpid(),
+		Command: command,
+		Start:   time.Now(),
+	}
+
+	for try := 0; ; try++ {
+		fid, err := os.OpenFile(lockFile(dir), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			holder := readLock(dir)
+			if holder == nil {
+				// Released since we tried
+				continue
+			}
+			if try == 0 && holder.stale() {
+				takeover(dir, holder)
+				continue
+			}
+			return &LockError{Dir: dir, Holder: holder}
+		} else if err != nil {
+			panic(err)
+		}
+
+		enc := json.NewEncoder(fid)
+		err = enc.Encode(li)
+		if err != nil {
+			panic(err)
+		}
+		fid.Close()
+		return nil
+	}
+}
+
+// MustLock acquires the lock on the dataset in TargetDir, as in Lock.
+// If the lock is held by another command, the reason is written to
+// stderr and the program exits.
+func MustLock(conf *Config, command string) {
+	err := Lock(conf, command)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%s: %v\n", command, err))
+		os.Exit(1)
+	}
+}
+
+// Unlock releases the lock on the dataset in TargetDir, if it is held
+// by this process.
+func Unlock(conf *Config) {
+	host, _ := os.Hostname()
+	li := readLock(conf.TargetDir)
+	if li != nil && li.Host == host && li.Pid == os.Getpid() {
+		os.Remove(lockFile(conf.TargetDir))
+	}
+}
@@ -0,0 +1,296 @@
+package config
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// Manifest describes a dataset so that downstream users can audit
+// and reproduce it.  It is stored as manifest.json in TargetDir, and
+// is rewritten after each stage of the pipeline.
+type Manifest struct {
+
+	// The dataset configuration, as in conf.json
+	NumBuckets  uint32
+	Compression string
+	CodesDir    string
+	Hash        string
+
+	// The dtype and code group of every variable
+	Schema map[string]*VarInfo
+
+	// Row counts and sizes of the buckets
+	Buckets []*BucketInfo
+
+	// The SAS files that the data were read from
+	Sources []*SourceInfo
+
+	// The variables that each bucket is sorted by, empty if the
+	// buckets are not sorted
+	SortKeys []string
+
+	// The stages that produced the dataset, in the order that
+	// they were run
+	Stages []*StageInfo
+
+	// The time that the manifest was written
+	Updated time.Time
+}
+
+// VarInfo describes one variable in a Manifest.
+type VarInfo struct {
+	Dtype string
+
+	// The prefix of the code group for factorized variables
+	CodeGroup string `json:",omitempty"`
+
+	// The normalizers applied to factorized variables
+	Normalize []string `json:",omitempty"`
+}
+
+// BucketInfo describes one bucket in a Manifest.
+type BucketInfo struct {
+	Rows int64
+
+	// Total compressed size of the column files
+	Bytes int64
+}
+
+// SourceInfo describes one source SAS file in a Manifest.
+type SourceInfo struct {
+	File    string
+	Size    int64
+	ModTime time.Time
+	Rows    int
+
+	// Conversion problems, totaled over the variables
+	ParseErrors int64
+	OutOfRange  int64
+	Truncated   int64
+}
+
+// StageInfo describes one run of a pipeline command in a Manifest.
+type StageInfo struct {
+	Command   string
+	Args      []string
+	Version   string
+	GoVersion string
+	Host      string
+	Start     time.Time
+	End       time.Time
+}
+
+// ToolVersion returns the version of the running program, based on
+// its module version and version control revision if available.
+func ToolVersion() string {
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	v := bi.Main.Version
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			v += " " + s.Value
+		}
+	}
+
+	return v
+}
+
+// ReadManifest returns the manifest of the dataset, or an empty
+// manifest if none has been written.
+func ReadManifest(conf *Config) *Manifest {
+
+	m := new(Manifest)
+
+	fid, err := os.Open(path.Join(conf.TargetDir, "manifest.json"))
+	if os.IsNotExist(err) {
+		return m
+	} else if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(m)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// countrows returns the number of values in a column file.
+func countrows(fname, dt string) int64 {
+
+	fid, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	rdr := bufio.NewReader(snappy.NewReader(fid))
+
+	var n int64
+	switch dt {
+	case "uvarint":
+		for {
+			b, err := rdr.ReadByte()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				panic(err)
+			}
+			// The last byte of each uvarint has the high bit unset.
+			if b < 0x80 {
+				n++
+			}
+		}
+	case "string":
+		for {
+			b, err := rdr.ReadByte()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				panic(err)
+			}
+			if b == '\n' {
+				n++
+			}
+		}
+	default:
+		m, err := io.Copy(ioutil.Discard, rdr)
+		if err != nil {
+			panic(err)
+		}
+		n = m / int64(DTsize[dt])
+	}
+
+	return n
+}
+
+// scanbucket returns the row count and size of one bucket.
+func scanbucket(bucket int, conf *Config, dtypes map[string]string) *BucketInfo {
+
+	bi := new(BucketInfo)
+	bp := BucketPath(bucket, conf)
+
+	// Count the rows using a fixed width variable if possible,
+	// since it is not necessary to parse the values.
+	var names []string
+	for vn := range dtypes {
+		names = append(names, vn)
+	}
+	sort.Strings(names)
+	var cvar string
+	for _, vn := range names {
+		if _, ok := DTsize[dtypes[vn]]; ok {
+			cvar = vn
+			break
+		}
+	}
+	if cvar == "" && len(names) > 0 {
+		cvar = names[0]
+	}
+	if cvar != "" {
+		bi.Rows = countrows(path.Join(bp, cvar+".bin.sz"), dtypes[cvar])
+	}
+
+	for vn := range dtypes {
+		fi, err := os.Stat(path.Join(bp, vn+".bin.sz"))
+		if err == nil {
+			bi.Bytes += fi.Size()
+		}
+	}
+
+	return bi
+}
+
+// UpdateManifest rescans the dataset and rewrites its manifest,
+// recording a stage that was run by the given command, starting at
+// the given time.  If f is not nil, it is called to modify the
+// manifest before the dataset is scanned and the stage is recorded.
+func UpdateManifest(conf *Config, command string, start time.Time, f func(*Manifest)) {
+
+	m := ReadManifest(conf)
+
+	if f != nil {
+		f(m)
+	}
+
+	m.NumBuckets = conf.NumBuckets
+	m.Compression = "snappy"
+	m.CodesDir = conf.CodesDir
+	m.Hash = conf.Hash
+
+	// The schema is the same in every bucket.
+	dtypes := ReadDtypes(0, conf)
+	groups := ReadCodeGroupInfo(conf)
+	m.Schema = make(map[string]*VarInfo)
+	for vn, dt := range dtypes {
+		vi := &VarInfo{Dtype: dt}
+		if cg, ok := groups[vn]; ok && dt == "uvarint" {
+			vi.CodeGroup = cg.Prefix
+			vi.Normalize = cg.Normalize
+		}
+		m.Schema[vn] = vi
+	}
+
+	// Scan the buckets concurrently.
+	m.Buckets = make([]*BucketInfo, conf.NumBuckets)
+	sem := make(chan bool, conf.Concurrency)
+	for k := range m.Buckets {
+		sem <- true
+		go func(k int) {
+			defer func() { <-sem }()
+			m.Buckets[k] = scanbucket(k, conf, dtypes)
+		}(k)
+	}
+	for k := 0; k < cap(sem); k++ {
+		sem <- true
+	}
+
+	host, _ := os.Hostname()
+	st := &StageInfo{
+		Command:   command,
+		Args:      os.Args[1:],
+		Version:   ToolVersion(),
+		GoVersion: runtime.Version(),
+		Host:      host,
+		Start:     start,
+		End:       time.Now(),
+	}
+	m.Stages = append(m.Stages, st)
+
+	m.Updated = time.Now()
+
+	fid, err := CreateAtomic(path.Join(conf.TargetDir, "manifest.json"))
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Abort()
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	_, err = fid.Write(b)
+	if err != nil {
+		panic(err)
+	}
+	err = fid.Commit()
+	if err != nil {
+		panic(err)
+	}
+}
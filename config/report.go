@@ -0,0 +1,313 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// The number of offending values kept for each variable in a
+	// conversion report.
+	MaxSamples = 10
+)
+
+// VarReport summarizes one variable in a SAS file, and describes the
+// problems found when converting it.
+type VarReport struct {
+
+	// Number of missing values, including empty strings
+	Missing int64
+
+	// Range of the non-missing values of numeric variables
+	Min *float64 `json:",omitempty"`
+	Max *float64 `json:",omitempty"`
+
+	// Estimated number of distinct values of string variables
+	Distinct int64 `json:",omitempty"`
+
+	// Number of string values that could not be parsed
+	ParseErrors int64
+
+	// Number of values outside the range of the variable's type
+	OutOfRange int64
+
+	// Number of numeric values with a fractional part that was
+	// dropped when converting to an integer type
+	Truncated int64
+
+	// Examples of values that could not be converted
+	Samples []string `json:",omitempty"`
+
+	// Sketch of the distinct string values
+	hll *HLL
+}
+
+// FileReport describes the conversion of one SAS file.
+type FileReport struct {
+	File string
+
+	// Number of rows read from the file
+	RowsRead int64
+
+	// Number of rows that were skipped because the key variable
+	// was missing
+	RowsDroppedKey int64
+
+	// Number of rows that did not satisfy the filter expression
+	RowsFiltered int64
+
+	// Variables that are not required and were not found in the
+	// file
+	AbsentVars []string `json:",omitempty"`
+
+	// Reports for each variable
+	Vars map[string]*VarReport
+}
+
+// NewFileReport returns an empty report for the given SAS file.
+func NewFileReport(file string) *FileReport {
+	return &FileReport{File: file, Vars: make(map[string]*VarReport)}
+}
+
+// Var returns the report for the given variable, creating it if
+// necessary.
+func (r *FileReport) Var(name string) *VarReport {
+	vr, ok := r.Vars[name]
+	if !ok {
+		vr = new(VarReport)
+		r.Vars[name] = vr
+	}
+	return vr
+}
+
+func (vr *VarReport) sample(value string) {
+	if len(vr.Samples) < MaxSamples {
+		vr.Samples = append(vr.Samples, value)
+	}
+}
+
+// ParseError records that a string value of the given variable could
+// not be converted, with err as returned by the parsing function.
+func (r *FileReport) ParseError(name, value string, err error) {
+	vr := r.Var(name)
+	if errors.Is(err, strconv.ErrRange) {
+		vr.OutOfRange++
+	} else {
+		vr.ParseErrors++
+	}
+	vr.sample(value)
+}
+
+// AddFloats adds a segment of a numeric variable to the report.  The
+// missing value indicators in miss may be nil if there are none.
+func (r *FileReport) AddFloats(name string, x []float64, miss []bool) {
+
+	vr := r.Var(name)
+	for i, v := range x {
+		if (miss != nil && miss[i]) || math.IsNaN(v) {
+			vr.Missing++
+			continue
+		}
+		if vr.Min == nil {
+			vr.Min = new(float64)
+			vr.Max = new(float64)
+			*vr.Min = v
+			*vr.Max = v
+		} else if v < *vr.Min {
+			*vr.Min = v
+		} else if v > *vr.Max {
+			*vr.Max = v
+		}
+	}
+}
+
+// AddStrings adds a segment of a string variable to the report.  As in
+// AddFloats, miss may be nil.
+func (r *FileReport) AddStrings(name string, x []string, miss []bool) {
+
+	vr := r.Var(name)
+	if vr.hll == nil {
+		vr.hll = NewHLL()
+	}
+	for i, v := range x {
+		if (miss != nil && miss[i]) || len(v) == 0 {
+			vr.Missing++
+			continue
+		}
+		vr.hll.AddString(v)
+	}
+}
+
+// Absent records that a variable that is not required was not found
+// in the file.
+func (r *FileReport) Absent(name string) {
+	for _, vn := range r.AbsentVars {
+		if vn == name {
+			return
+		}
+	}
+	r.AbsentVars = append(r.AbsentVars, name)
+}
+
+// RecordOutOfRange records that a numeric value of the given variable
+// was out of range for the variable's type.
+func (r *FileReport) RecordOutOfRange(name string, x float64) {
+	vr := r.Var(name)
+	vr.OutOfRange++
+	vr.sample(strconv.FormatFloat(x, 'g', -1, 64))
+}
+
+// RecordTruncated records that a numeric value of the given variable
+// had a fractional part that was dropped.
+func (r *FileReport) RecordTruncated(name string, x float64) {
+	vr := r.Var(name)
+	vr.Truncated++
+	vr.sample(strconv.FormatFloat(x, 'g', -1, 64))
+}
+
+// Totals returns the total number of parse errors, out of range
+// values, and truncated values over all variables.
+func (r *FileReport) Totals() (int64, int64, int64) {
+	var pe, oor, tr int64
+	for _, vr := range r.Vars {
+		pe += vr.ParseErrors
+		oor += vr.OutOfRange
+		tr += vr.Truncated
+	}
+	return pe, oor, tr
+}
+
+// Merge adds the counts in another report for the same file into r.
+func (r *FileReport) Merge(s *FileReport) {
+
+	r.RowsRead += s.RowsRead
+	r.RowsDroppedKey += s.RowsDroppedKey
+	r.RowsFiltered += s.RowsFiltered
+	for _, vn := range s.AbsentVars {
+		r.Absent(vn)
+	}
+
+	for vn, svr := range s.Vars {
+		vr := r.Var(vn)
+		vr.Missing += svr.Missing
+		vr.ParseErrors += svr.ParseErrors
+		vr.OutOfRange += svr.OutOfRange
+		vr.Truncated += svr.Truncated
+		for _, x := range svr.Samples {
+			vr.sample(x)
+		}
+		if svr.Min != nil {
+			if vr.Min == nil {
+				vr.Min = new(float64)
+				vr.Max = new(float64)
+				*vr.Min = *svr.Min
+				*vr.Max = *svr.Max
+			} else {
+				*vr.Min = math.Min(*vr.Min, *svr.Min)
+				*vr.Max = math.Max(*vr.Max, *svr.Max)
+			}
+		}
+		if svr.hll != nil {
+			if vr.hll == nil {
+				vr.hll = NewHLL()
+			}
+			vr.hll.Merge(svr.hll)
+		}
+	}
+}
+
+// WriteReport writes the conversion reports for a collection of SAS
+// files to sastocols_report.json in TargetDir.  The reports for
+// appended data are written to sastocols_report_append_{time}.json
+// instead, so that the reports of earlier runs are kept.
+func WriteReport(conf *Config, reports map[string]*FileReport) {
+
+	var rl []*FileReport
+	for _, r := range reports {
+		for _, vr := range r.Vars {
+			if vr.hll != nil {
+				vr.Distinct = vr.hll.Estimate()
+			}
+		}
+		sort.Strings(r.AbsentVars)
+		rl = append(rl, r)
+	}
+	sort.Slice(rl, func(i, j int) bool { return rl[i].File < rl[j].File })
+
+	fname := "sastocols_report.json"
+	if conf.Append {
+		fname = fmt.Sprintf("sastocols_report_append_%s.json", time.Now().Format("20060102T150405"))
+	}
+
+	fid, err := os.Create(path.Join(conf.TargetDir, fname))
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	b, err := json.MarshalIndent(rl, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	_, err = fid.Write(b)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ParseUint parses s as an unsigned integer that fits in the given
+// number of bits.  Values written in decimal form, such as "12.0",
+// are accepted if they are whole numbers.  As in strconv.ParseUint,
+// if the value is out of range the error is strconv.ErrRange and the
+// nearest value in range is returned.
+func ParseUint(s string, bits int) (uint64, error) {
+
+	x, err := strconv.ParseUint(s, 10, bits)
+	if err == nil || errors.Is(err, strconv.ErrRange) {
+		return x, err
+	}
+
+	f, ferr := strconv.ParseFloat(s, 64)
+	if ferr != nil || f != math.Trunc(f) {
+		return 0, err
+	}
+	if f < 0 {
+		return 0, &strconv.NumError{Func: "ParseUint", Num: s, Err: strconv.ErrRange}
+	}
+	if f > math.Ldexp(1, bits)-1 {
+		return 1<<uint(bits) - 1, &strconv.NumError{Func: "ParseUint", Num: s, Err: strconv.ErrRange}
+	}
+
+	return uint64(f), nil
+}
+
+// ParseInt parses s as a signed integer that fits in the given number
+// of bits.  Values written in decimal form, such as "12.0", are
+// accepted if they are whole numbers.  Out of range values are
+// handled as in ParseUint.
+func ParseInt(s string, bits int) (int64, error) {
+
+	x, err := strconv.ParseInt(s, 10, bits)
+	if err == nil || errors.Is(err, strconv.ErrRange) {
+		return x, err
+	}
+
+	f, ferr := strconv.ParseFloat(s, 64)
+	if ferr != nil || f != math.Trunc(f) {
+		return 0, err
+	}
+	if f < -math.Ldexp(1, bits-1) {
+		return -1 << uint(bits-1), &strconv.NumError{Func: "ParseInt", Num: s, Err: strconv.ErrRange}
+	}
+	if f > math.Ldexp(1, bits-1)-1 {
+		return 1<<uint(bits-1) - 1, &strconv.NumError{Func: "ParseInt", Num: s, Err: strconv.ErrRange}
+	}
+
+	return int64(f), nil
+}
@@ -0,0 +1,305 @@
+package config
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+var (
+	// Serializes updates to the statistics files within a process.
+	statmut sync.Mutex
+)
+
+// ColumnStats summarizes the values in one column of a bucket, so
+// that buckets can be skipped when looking for values in a given
+// range.  The statistics describe the values as stored, e.g. dates
+// are days since 1970-01-01 and factorized variables are codes.
+// Integer values are converted to float64, which may round large
+// values, but rounding preserves order so comparisons made in
+// float64 remain valid.
+type ColumnStats struct {
+	Rows int64
+
+	// Number of missing values, which are NaN in floating point
+	// columns, MissingDate or MissingDatetime in date and
+	// datetime columns, and empty strings in string columns.
+	// Integer columns store missing values as zero, so they do
+	// not have any nulls.
+	Nulls int64
+
+	// Range of the non-missing values of numeric columns
+	Min *float64 `json:",omitempty"`
+	Max *float64 `json:",omitempty"`
+
+	// Number of distinct codes in factorized (uvarint) columns
+	Levels int64 `json:",omitempty"`
+
+	// The distinct codes seen so far
+	codes map[uint64]bool
+}
+
+// Add adds a numeric value to the statistics.
+func (cs *ColumnStats) Add(x float64) {
+
+	cs.Rows++
+	if math.IsNaN(x) {
+		cs.Nulls++
+		return
+	}
+
+	if cs.Min == nil {
+		cs.Min = new(float64)
+		cs.Max = new(float64)
+		*cs.Min = x
+		*cs.Max = x
+	} else if x < *cs.Min {
+		*cs.Min = x
+	} else if x > *cs.Max {
+		*cs.Max = x
+	}
+}
+
+// AddDate adds a date value to the statistics.
+func (cs *ColumnStats) AddDate(d int32) {
+	if d == MissingDate {
+		cs.Add(math.NaN())
+	} else {
+		cs.Add(float64(d))
+	}
+}
+
+// AddDatetime adds a datetime value to the statistics.
+func (cs *ColumnStats) AddDatetime(s int64) {
+	if s == MissingDatetime {
+		cs.Add(math.NaN())
+	} else {
+		cs.Add(float64(s))
+	}
+}
+
+// AddString adds a string value to the statistics.
+func (cs *ColumnStats) AddString(s string) {
+	cs.Rows++
+	if len(s) == 0 {
+		cs.Nulls++
+	}
+}
+
+// AddCode adds a factor code to the statistics.
+func (cs *ColumnStats) AddCode(c uint64) {
+
+	cs.Add(float64(c))
+
+	if cs.codes == nil {
+		cs.codes = make(map[uint64]bool)
+	}
+	if !cs.codes[c] {
+		cs.codes[c] = true
+		cs.Levels++
+	}
+}
+
+// Overlaps returns false if the column cannot contain any values in
+// the closed interval [lo, hi].  Use infinite values for intervals
+// that are unbounded on one side.  String columns overlap every
+// interval unless all of their values are missing.
+func (cs *ColumnStats) Overlaps(lo, hi float64) bool {
+	if cs.Min == nil {
+		return cs.Rows > cs.Nulls
+	}
+	return *cs.Max >= lo && *cs.Min <= hi
+}
+
+// FixedStats returns the statistics of fixed width data with the
+// given dtype.
+func FixedStats(b []byte, dt string) *ColumnStats {
+
+	w, ok := DTsize[dt]
+	if !ok {
+		msg := fmt.Sprintf("No size information for dtype %s\n", dt)
+		panic(msg)
+	}
+
+	cs := new(ColumnStats)
+	le := binary.LittleEndian
+	for i := 0; i+w <= len(b); i += w {
+		switch dt {
+		case "uint8":
+			cs.Add(float64(b[i]))
+		case "uint16":
+			cs.Add(float64(le.Uint16(b[i:])))
+		case "uint32":
+			cs.Add(float64(le.Uint32(b[i:])))
+		case "uint64":
+			cs.Add(float64(le.Uint64(b[i:])))
+		case "int32":
+			cs.Add(float64(int32(le.Uint32(b[i:]))))
+		case "int64":
+			cs.Add(float64(int64(le.Uint64(b[i:]))))
+		case "date":
+			cs.AddDate(int32(le.Uint32(b[i:])))
+		case "datetime":
+			cs.AddDatetime(int64(le.Uint64(b[i:])))
+		case "float32":
+			cs.Add(float64(math.Float32frombits(le.Uint32(b[i:]))))
+		case "float64":
+			cs.Add(math.Float64frombits(le.Uint64(b[i:])))
+		}
+	}
+
+	return cs
+}
+
+// CodeStats returns the statistics of factor codes.
+func CodeStats(x []uint64) *ColumnStats {
+	cs := new(ColumnStats)
+	for _, c := range x {
+		cs.AddCode(c)
+	}
+	return cs
+}
+
+// StringStats returns the statistics of string data.
+func StringStats(x []string) *ColumnStats {
+	cs := new(ColumnStats)
+	for _, s := range x {
+		cs.AddString(s)
+	}
+	return cs
+}
+
+// ScanStats reads a column file with the given dtype and returns the
+// statistics of its values.
+func ScanStats(fname, dt string) (*ColumnStats, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	b, err := ioutil.ReadAll(snappy.NewReader(fid))
+	if err != nil {
+		return nil, err
+	}
+
+	switch dt {
+	case "uvarint":
+		cs := new(ColumnStats)
+		for len(b) > 0 {
+			c, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, fmt.Errorf("%s: invalid uvarint data", fname)
+			}
+			cs.AddCode(c)
+			b = b[n:]
+		}
+		return cs, nil
+	case "string":
+		cs := new(ColumnStats)
+		for len(b) > 0 {
+			i := bytes.IndexByte(b, '\n')
+			if i < 0 {
+				cs.AddString(string(b))
+				break
+			}
+			cs.AddString(string(b[0:i]))
+			b = b[i+1:]
+		}
+		return cs, nil
+	}
+
+	return FixedStats(b, dt), nil
+}
+
+// ReadStats returns the statistics recorded for the columns in a
+// bucket directory, as a map from variable names to statistics.
+func ReadStats(dir string) map[string]*ColumnStats {
+
+	stats := make(map[string]*ColumnStats)
+
+	fid, err := os.Open(path.Join(dir, "stats.json"))
+	if os.IsNotExist(err) {
+		return stats
+	} else if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(&stats)
+	if err != nil {
+		panic(err)
+	}
+
+	return stats
+}
+
+// SetStats records statistics for the given columns in a bucket
+// directory.  The statistics of other columns are not changed.
+func SetStats(dir string, stats map[string]*ColumnStats) {
+
+	statmut.Lock()
+	defer statmut.Unlock()
+
+	all := ReadStats(dir)
+	for vn, cs := range stats {
+		all[vn] = cs
+	}
+
+	WriteJSON(path.Join(dir, "stats.json"), all)
+}
+
+// UpdateStats recomputes and records the statistics of one column
+// file with the given dtype.
+func UpdateStats(fname, dt string) {
+
+	cs, err := ScanStats(fname, dt)
+	if err != nil {
+		panic(err)
+	}
+
+	d, f := path.Split(fname)
+	vn := f[0 : len(f)-len(".bin.sz")]
+	SetStats(d, map[string]*ColumnStats{vn: cs})
+}
+
+// Bound restricts the values of a variable to the closed interval
+// [Lo, Hi].
+type Bound struct {
+	Var string
+	Lo  float64
+	Hi  float64
+}
+
+// PruneBuckets returns the buckets that may contain rows satisfying
+// all of the given bounds.  Buckets are only skipped if their
+// statistics show that they have no matching rows, so buckets and
+// variables without statistics are always returned.
+func PruneBuckets(conf *Config, bounds []Bound) []int {
+
+	var keep []int
+	for k := 0; k < int(conf.NumBuckets); k++ {
+		stats := ReadStats(BucketPath(k, conf))
+		ok := true
+		for _, b := range bounds {
+			if cs, has := stats[b.Var]; has && !cs.Overlaps(b.Lo, b.Hi) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			keep = append(keep, k)
+		}
+	}
+
+	return keep
+}
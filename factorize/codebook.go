@@ -0,0 +1,309 @@
+package factorize
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kshedden/gosascols/config"
+)
+
+// Level describes one factor code in a codebook.
+type Level struct {
+
+	// The integer code
+	Code int
+
+	// The value that is coded, after normalization
+	Label string
+
+	// The number of times that the level occurs in the data.  For
+	// OtherLabel, this is the total count of the collapsed levels.
+	Count uint64
+
+	// An optional human-readable description of the level
+	Description string `json:",omitempty"`
+}
+
+// Codebook describes the factor codes of a group of variables.  It is
+// stored alongside the codes file, replacing Codes.json with
+// Codebook.json in its name.  Unlike the codes file, which only maps
+// the labels to their codes, the codebook records the levels in code
+// order with their counts and descriptions, and how the codes were
+// assigned.
+type Codebook struct {
+
+	// The prefix of the code group
+	Prefix string
+
+	// The version of the codes, as in CodesMeta
+	Version int
+
+	// The time that the codes were first assigned
+	Created time.Time
+
+	// The time that the codebook was last changed
+	Updated time.Time
+
+	// The options used to assign the codes, see Options
+	Order     string
+	MinFreq   uint64   `json:",omitempty"`
+	TopK      int      `json:",omitempty"`
+	Normalize []string `json:",omitempty"`
+
+	// The TargetDir of each dataset whose values were counted
+	Sources []string
+
+	// The levels, in code order
+	Levels []*Level
+
+	// Indices used to look up levels
+	bycode  map[int]*Level
+	bylabel map[string]*Level
+	xf      xfunc
+}
+
+func codebookFile(codesfile string) string {
+	return strings.Replace(codesfile, "Codes.json", "Codebook.json", 1)
+}
+
+// index builds the indices used to look up levels.
+func (cb *Codebook) index() {
+
+	cb.bycode = make(map[int]*Level)
+	cb.bylabel = make(map[string]*Level)
+	for _, lv := range cb.Levels {
+		cb.bycode[lv.Code] = lv
+		cb.bylabel[lv.Label] = lv
+	}
+
+	var err error
+	cb.xf, err = NewNormalizer(cb.Normalize)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// readCodebookFile returns the codebook in the given file, or nil if
+// the file does not exist.
+func readCodebookFile(fname string) *Codebook {
+
+	fid, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	cb := new(Codebook)
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(cb)
+	if err != nil {
+		panic(err)
+	}
+
+	return cb
+}
+
+// ReadCodebook returns the codebook of the codes in the given codes
+// file.  Codes that were assigned before codebooks were written have
+// no codebook, in which case the codebook is made from the codes file
+// and has no counts, descriptions or normalizers.
+func ReadCodebook(codesfile string) *Codebook {
+
+	cb := readCodebookFile(codebookFile(codesfile))
+
+	if cb == nil {
+		meta := ReadCodesMeta(codesfile)
+		cb = &Codebook{Version: meta.Version, Updated: meta.Updated}
+		for c, k := range ReadLabels(codesfile) {
+			cb.Levels = append(cb.Levels, &Level{Code: c, Label: k})
+		}
+		sort.Slice(cb.Levels, func(i, j int) bool { return cb.Levels[i].Code < cb.Levels[j].Code })
+	}
+
+	cb.index()
+
+	return cb
+}
+
+// Label returns the label of a code.  The second return value is
+// false if the code is not in the codebook.
+func (cb *Codebook) Label(code int) (string, bool) {
+	lv, ok := cb.bycode[code]
+	if !ok {
+		return "", false
+	}
+	return lv.Label, true
+}
+
+// Code returns the code of a value.  The value is normalized as it
+// was when the data were factorized, and a value that does not have
+// its own code gets the code of OtherLabel, if there is one.  The
+// second return value is false if the value has no code.
+func (cb *Codebook) Code(value string) (int, bool) {
+	if cb.xf != nil {
+		value = cb.xf(value)
+	}
+	if lv, ok := cb.bylabel[value]; ok {
+		return lv.Code, true
+	}
+	if lv, ok := cb.bylabel[OtherLabel]; ok {
+		return lv.Code, true
+	}
+	return 0, false
+}
+
+// Description returns the description of a code, which is empty if
+// the code has no description.
+func (cb *Codebook) Description(code int) string {
+	if lv, ok := cb.bycode[code]; ok {
+		return lv.Description
+	}
+	return ""
+}
+
+// readDescriptions reads a csv file whose first two columns are a
+// value and its description.  The values are normalized in the same
+// way as the data.
+func readDescriptions(fname string) map[string]string {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	rdr := csv.NewReader(fid)
+	rdr.FieldsPerRecord = -1
+	rdr.LazyQuotes = true
+
+	desc := make(map[string]string)
+	for line := 1; ; line++ {
+		rec, err := rdr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			panic(err)
+		}
+		if len(rec) < 2 {
+			msg := fmt.Sprintf("%s, line %d: expected a value and a description\n", fname, line)
+			panic(msg)
+		}
+		k := rec[0]
+		if xf != nil {
+			k = xf(k)
+		}
+		desc[k] = rec[1]
+	}
+
+	return desc
+}
+
+// othercount returns the total count of the levels that are collapsed
+// into OtherLabel.
+func othercount() uint64 {
+	n := rarecount
+	for k, v := range freq {
+		if _, ok := codes[k]; !ok {
+			n += v
+		}
+	}
+	return n
+}
+
+// makeCodebook returns the codebook of the current codes, after the
+// command given by mode ("run", "update" or "extend").  After "run",
+// the codes are new, so only the descriptions of the existing
+// codebook are kept.  After "update", the counts and options replace
+// those in the codebook, and the sources are added.  After "extend",
+// the data are being appended to the data that were counted for the
+// existing codebook, so the counts are added to the existing counts,
+// and the recorded options are kept.  The descriptions are from
+// opts.Descriptions if it is set, otherwise the existing descriptions
+// are kept.
+func makeCodebook(prefix string, sources []string, mode string) *Codebook {
+
+	old := readCodebookFile(codebookFile(codesFile))
+
+	cb := &Codebook{
+		Prefix:    prefix,
+		Version:   ReadCodesMeta(codesFile).Version,
+		Created:   time.Now(),
+		Updated:   time.Now(),
+		Order:     opts.Order,
+		MinFreq:   opts.MinFreq,
+		TopK:      opts.TopK,
+		Normalize: opts.Normalize,
+	}
+
+	// The levels and counts of the existing codebook
+	oldlevels := make(map[string]*Level)
+	srcs := make(map[string]bool)
+	if old != nil && mode != "run" {
+		cb.Created = old.Created
+		if mode == "extend" {
+			cb.Prefix = old.Prefix
+			cb.Order = old.Order
+			cb.MinFreq = old.MinFreq
+			cb.TopK = old.TopK
+			cb.Normalize = old.Normalize
+		}
+		for _, s := range old.Sources {
+			srcs[s] = true
+		}
+	}
+	if old != nil {
+		for _, lv := range old.Levels {
+			oldlevels[lv.Label] = lv
+		}
+	}
+	for _, s := range sources {
+		srcs[s] = true
+	}
+	for s := range srcs {
+		cb.Sources = append(cb.Sources, s)
+	}
+	sort.Strings(cb.Sources)
+
+	var ndesc int
+	for k, c := range codes {
+		lv := &Level{Code: c, Label: k, Count: freq[k]}
+		if k == OtherLabel {
+			lv.Count = othercount()
+		}
+		ol, ok := oldlevels[k]
+		if mode == "extend" && ok {
+			lv.Count += ol.Count
+		}
+		if descriptions != nil {
+			lv.Description = descriptions[k]
+		} else if ok {
+			lv.Description = ol.Description
+		}
+		if lv.Description != "" {
+			ndesc++
+		}
+		cb.Levels = append(cb.Levels, lv)
+	}
+	sort.Slice(cb.Levels, func(i, j int) bool { return cb.Levels[i].Code < cb.Levels[j].Code })
+
+	if descriptions != nil {
+		logger.Printf("Found descriptions of %d of %d levels in %s", ndesc, len(codes), opts.Descriptions)
+	}
+
+	return cb
+}
+
+// writeCodebook saves the codebook of a group.
+func writeCodebook(g *Group) {
+	fname := codebookFile(g.CodesFile)
+	config.WriteJSON(fname, g.codebook)
+	logger.Printf("Wrote the codebook to %s", fname)
+}
@@ -0,0 +1,69 @@
+package factorize
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/kshedden/gosascols/config"
+)
+
+// Estimate returns an estimate of the number of distinct values in
+// the given files, after normalization, and the total number of
+// values.  The estimate uses a HyperLogLog sketch, so it is fast and
+// uses little memory, and is accurate to within a few percent.  It
+// can be used to decide whether a factorization needs to spill its
+// frequency counts to disk, or whether rare levels should be
+// collapsed.
+func Estimate(files []string, o *Options, lgr *log.Logger) (int64, uint64) {
+
+	logger = lgr
+	setopts(o)
+
+	hll := config.NewHLL()
+	var total uint64
+	var mut sync.Mutex
+
+	sem := make(chan bool, concurrency)
+	for _, file := range files {
+		sem <- true
+		go func(file string) {
+			defer func() { <-sem }()
+
+			fid, err := os.Open(file)
+			if err != nil {
+				panic(err)
+			}
+			defer fid.Close()
+
+			h := config.NewHLL()
+			var n uint64
+			scanner := bufio.NewScanner(snappy.NewReader(fid))
+			for ; scanner.Scan(); n++ {
+				tok := scanner.Text()
+				if xf != nil {
+					tok = xf(tok)
+				}
+				h.AddString(tok)
+			}
+			if err := scanner.Err(); err != nil {
+				panic(err)
+			}
+
+			mut.Lock()
+			hll.Merge(h)
+			total += n
+			mut.Unlock()
+		}(file)
+	}
+	for k := 0; k < concurrency; k++ {
+		sem <- true
+	}
+
+	est := hll.Estimate()
+	logger.Printf("Estimated %d distinct values among %d values in %d files", est, total, len(files))
+
+	return est, total
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"strings"
+	"time"
 	"unicode"
 
+	"github.com/BurntSushi/toml"
 	"github.com/kshedden/gosascols/config"
 	"github.com/kshedden/gosascols/factorize"
 )
@@ -19,9 +23,13 @@ var (
 	// If multi=true, all variables named {prefix}# are unified
 	// into a single variable of uvarint type.  Otherwise, only
 	// the variable named prefix is factorized and converted to
-	// uvarint.
+	// uvarint.  It is set for each group in turn.
 	multi bool
 
+	// If appending=true, the variables in the staging area of
+	// each dataset are factorized using the existing codes.
+	appending bool
+
 	logger *log.Logger
 )
 
@@ -31,8 +39,21 @@ func getfilenames(tp string) ([]string, map[string][]string) {
 	for _, cnf := range conf {
 		for k := 0; k < int(cnf.NumBuckets); k++ {
 			px := config.BucketPath(k, cnf)
+
+			// When appending, only the staged string variables
+			// that are factorized in the existing data are
+			// processed.
+			var olddt, newdt map[string]string
+			if appending {
+				olddt = config.ReadDtypes(k, cnf)
+				px = config.StagePath(k, cnf)
+				newdt = getdtypes(px)
+			}
+
 			fl, err := ioutil.ReadDir(px)
-			if err != nil {
+			if appending && os.IsNotExist(err) {
+				continue
+			} else if err != nil {
 				panic(err)
 			}
 			for _, f := range fl {
@@ -58,6 +79,11 @@ func getfilenames(tp string) ([]string, map[string][]string) {
 				}
 
 				vname := strings.Replace(fn, ".bin.sz", "", 1)
+
+				if appending && !(newdt[vname] == "string" && olddt[vname] == "uvarint") {
+					continue
+				}
+
 				vnames[cnf.TargetDir] = append(vnames[cnf.TargetDir], vname)
 				files = append(files, path.Join(px, fn))
 			}
@@ -67,6 +93,28 @@ func getfilenames(tp string) ([]string, map[string][]string) {
 	return files, vnames
 }
 
+// getdtypes returns the dtypes for the bucket in directory dir, or nil
+// if the directory does not exist.
+func getdtypes(dir string) map[string]string {
+
+	fid, err := os.Open(path.Join(dir, "dtypes.json"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	dtypes := make(map[string]string)
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(&dtypes)
+	if err != nil {
+		panic(err)
+	}
+
+	return dtypes
+}
+
 func setupLogger(prefix string) {
 	fid, err := os.Create(fmt.Sprintf("factorize_%s.log", prefix))
 	if err != nil {
@@ -75,77 +123,465 @@ func setupLogger(prefix string) {
 	logger = log.New(fid, "", log.Ltime)
 }
 
-// revert undoes all factorizations in the directories containing thre
-// provided files.  Note that the reversion applies to all factorized
-// files, not only the files with the given prefix type.
-func revert(files []string) {
+// revert undoes the factorization of the variables in a group,
+// restoring their string values and dtypes.  The variables in the
+// group are those recorded with the group's prefix in CodeGroups.json,
+// and the variables in other groups remain factorized.
+func revert(g *factorize.Group) {
+
+	fmt.Printf("Reverting the variables with prefix %s\n", g.Prefix)
+
+	var labels map[int]string
+	var nrestored, ndecoded int
+
+	for _, cnf := range conf {
+
+		prefile := path.Join(cnf.TargetDir, "CodeGroups.json")
+		groups := config.ReadCodeGroupFile(prefile)
+
+		// The variable names are listed once for each bucket.
+		var vnames []string
+		seen := make(map[string]bool)
+		for _, vn := range g.VarNames[cnf.TargetDir] {
+			if cg, ok := groups[vn]; ok && cg.Prefix == g.Prefix && !seen[vn] {
+				vnames = append(vnames, vn)
+				seen[vn] = true
+			}
+		}
+		if len(vnames) == 0 {
+			continue
+		}
+		logger.Printf("Reverting %v in %s", vnames, cnf.TargetDir)
+
+		if labels == nil {
+			labels = factorize.ReadLabels(g.CodesFile)
+		}
+
+		// Once no variables are factorized, the dtypes before
+		// factorization are no longer needed.
+		last := len(vnames) == len(groups)
+
+		for k := 0; k < int(cnf.NumBuckets); k++ {
+			nr, nd := revertbucket(config.BucketPath(k, cnf), vnames, labels, groups, last)
+			nrestored += nr
+			ndecoded += nd
+		}
+
+		for _, vn := range vnames {
+			delete(groups, vn)
+		}
+		config.WriteCodeGroupFile(prefile, groups)
+	}
+
+	msg := fmt.Sprintf("Restored %d files from their backups, decoded %d files using %s\n",
+		nrestored, ndecoded, g.CodesFile)
+	logger.Print(msg)
+	os.Stdout.WriteString(msg)
+}
+
+// revertbucket restores the string values of the given variables in
+// one bucket, returning the number of files restored from their
+// backups and the number of files decoded using the labels.  The
+// files that are changed are backed up until the reversion is
+// finished, so that if it is interrupted, the recover tool can undo
+// it.  If last is true, no variables remain factorized.
+func revertbucket(dir string, vnames []string, labels map[int]string, groups map[string]*config.CodeGroup, last bool) (int, int) {
+
+	dtypes := getdtypes(dir)
+	var rv []string
+	for _, vn := range vnames {
+		if dtypes[vn] == "uvarint" {
+			rv = append(rv, vn)
+		}
+	}
+	if len(rv) == 0 {
+		return 0, 0
+	}
+
+	config.StartPending(dir, "factorize revert", "prerevert")
+	config.Backup(path.Join(dir, "dtypes.json"), "prerevert")
+	for _, vn := range rv {
+		config.Backup(path.Join(dir, vn+".bin.sz"), "prerevert")
+		sn := path.Join(dir, vn+"_string.bin.sz")
+		if _, err := os.Stat(sn); err == nil {
+			config.Backup(sn, "prerevert")
+		}
+	}
+
+	for _, vn := range rv {
+		dtypes[vn] = "string"
+	}
+	config.WriteJSON(path.Join(dir, "dtypes.json"), dtypes)
+
+	var nr, nd int
+	for _, vn := range rv {
+		fn := path.Join(dir, vn+".bin.sz")
+		if factorize.RevertColumn(fn, labels, groups[vn].Normalize) {
+			fmt.Printf("%s: restored\n", fn)
+			nr++
+		} else {
+			fmt.Printf("%s: decoded\n", fn)
+			nd++
+		}
+	}
 
-	print("reverting all factorized files with all prefixes...")
+	// If the bucket was sorted after it was factorized, the
+	// backups kept by sortbuckets hold codes.  They are replaced
+	// by their string values, so that sortbuckets revert restores
+	// columns that match dtypes.json.
+	od := path.Join(dir, "orig")
+	if odtypes := getdtypes(od); odtypes != nil {
+		for _, vn := range rv {
+			if odtypes[vn] == "uvarint" {
+				factorize.RevertBackup(path.Join(od, vn+".bin.sz"), labels, groups[vn].Normalize)
+				odtypes[vn] = "string"
+			}
+		}
+		config.WriteJSON(path.Join(od, "dtypes.json"), odtypes)
+	}
 
-	dm := make(map[string]bool)
-	for _, f := range files {
-		d, _ := path.Split(f)
-		dm[d] = true
+	config.FinishPending(dir)
+	err := os.RemoveAll(path.Join(dir, "prerevert"))
+	if err != nil {
+		panic(err)
 	}
 
-	for d, _ := range dm {
-		files, err := ioutil.ReadDir(d)
-		if err != nil {
+	if last {
+		err = os.Remove(path.Join(dir, "dtypes_string.json"))
+		if err != nil && !os.IsNotExist(err) {
 			panic(err)
 		}
-		for _, file := range files {
-			fn := file.Name()
-			if strings.HasSuffix(fn, "_string.bin.sz") || strings.HasSuffix(fn, "_string.json") {
-				nn := strings.Replace(fn, "_string", "", 1)
-				px1 := path.Join(d, fn)
-				px2 := path.Join(d, nn)
-				print(px1, " -> ", px2, "\n")
-				err := os.Rename(px1, px2)
-				if err != nil {
-					panic(err)
-				}
+	}
+
+	return nr, nd
+}
+
+// updateManifests records the factorization in the manifest of each
+// dataset.
+func updateManifests(start time.Time) {
+	for _, cnf := range conf {
+		config.UpdateManifest(cnf, "factorize", start, nil)
+	}
+}
+
+// lockall locks all of the datasets, or exits if any of them are
+// locked by another command.
+func lockall(command string) {
+	for j, cnf := range conf {
+		if err := config.Lock(cnf, command); err != nil {
+			for _, c := range conf[0:j] {
+				config.Unlock(c)
 			}
+			os.Stderr.WriteString(fmt.Sprintf("factorize: %v\n", err))
+			os.Exit(1)
+		}
+	}
+}
+
+func unlockall() {
+	for _, cnf := range conf {
+		config.Unlock(cnf)
+	}
+}
+
+// readlevels returns the levels listed in a file, one per line.
+func readlevels(fname string) []string {
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		panic(err)
+	}
+
+	var levels []string
+	for _, x := range strings.Split(string(b), "\n") {
+		x = strings.TrimRight(x, "\r")
+		if x != "" {
+			levels = append(levels, x)
 		}
 	}
+
+	return levels
+}
+
+// strlist is a flag that can be given multiple times.
+type strlist []string
+
+func (s *strlist) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *strlist) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// recordedGroup returns the code group recorded in CodeGroups.json
+// when the variables were first factorized, so that appended and
+// updated data are normalized and collapsed in the same way.  It
+// returns nil if none of the variables are recorded.
+func recordedGroup(vninfo map[string][]string) *config.CodeGroup {
+	for pa, vnames := range vninfo {
+		groups := config.ReadCodeGroupFile(path.Join(pa, "CodeGroups.json"))
+		for _, v := range vnames {
+			if g, ok := groups[v]; ok {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+// groupspec describes one group of variables in a groups file.  The
+// options that are not given are taken from the command line.
+type groupspec struct {
+	Prefix       string
+	Order        string
+	Levels       string
+	MinFreq      uint64
+	TopK         int
+	Normalize    []string
+	Descriptions string
+}
+
+// readgroups reads a toml file describing the groups of variables to
+// factorize, with one [[Group]] table per group.
+func readgroups(fname string) []*groupspec {
+
+	var gf struct {
+		Group []*groupspec
+	}
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		panic(err)
+	}
+	_, err = toml.Decode(string(b), &gf)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Reading %s\n", fname))
+		panic(err)
+	}
+
+	for _, g := range gf.Group {
+		if g.Prefix == "" {
+			os.Stderr.WriteString(fmt.Sprintf("factorize: group without a prefix in %s\n", fname))
+			os.Exit(1)
+		}
+	}
+
+	return gf.Group
+}
+
+// checkorder exits if the order is not known.
+func checkorder(order string) {
+	switch order {
+	case "count", "lexical", "firstseen":
+	default:
+		os.Stderr.WriteString(fmt.Sprintf("factorize: unknown order %s\n\n", order))
+		usage()
+		os.Exit(1)
+	}
+}
+
+// groupopts returns the options for a group, which are the command
+// line options with the options given for the group replacing them.
+func groupopts(base *factorize.Options, g *groupspec) *factorize.Options {
+
+	o := *base
+
+	if g.Order != "" {
+		checkorder(g.Order)
+		o.Order = g.Order
+		o.Levels = nil
+	}
+	if g.Levels != "" {
+		o.Order = "list"
+		o.Levels = readlevels(g.Levels)
+	}
+	if g.MinFreq != 0 {
+		o.MinFreq = g.MinFreq
+	}
+	if g.TopK != 0 {
+		o.TopK = g.TopK
+	}
+	if len(g.Normalize) > 0 {
+		if _, err := factorize.NewNormalizer(g.Normalize); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("factorize: %v\n", err))
+			os.Exit(1)
+		}
+		o.Normalize = g.Normalize
+	}
+	if g.Descriptions != "" {
+		o.Descriptions = g.Descriptions
+	}
+
+	return &o
+}
+
+func usage() {
+	os.Stderr.WriteString("Usage:\n  factorize (run|revert|append|update|estimate) [options] prefix[,prefix...] config...\n")
+	os.Stderr.WriteString("  factorize (run|revert|append|update|estimate) [options] -groups groups.toml config...\n\n")
+	os.Stderr.WriteString("Options:\n")
+	os.Stderr.WriteString("  -order (count|lexical|firstseen)  order in which codes are assigned\n")
+	os.Stderr.WriteString("  -levels file                      assign codes in the order listed in file\n")
+	os.Stderr.WriteString("  -minfreq n                        collapse levels seen fewer than n times\n")
+	os.Stderr.WriteString("  -topk k                           collapse all but the k most frequent levels\n")
+	os.Stderr.WriteString("  -normalize name                   normalize values before coding, may be repeated:\n")
+	os.Stderr.WriteString("                                    trim, upper, strippunct, icd, zeropad:W, regex:P:R\n")
+	os.Stderr.WriteString("  -spill dir                        spill frequency counts to files in dir\n")
+	os.Stderr.WriteString("  -descriptions file                csv file of values and their descriptions\n")
+	os.Stderr.WriteString("  -groups file                      factorize the groups of variables described in file\n")
 }
 
 func main() {
 
 	if len(os.Args) < 2 {
 		os.Stderr.WriteString("factorize: wrong number of arguments\n\n")
-		os.Stderr.WriteString("Usage:\n  factorize (run|revert) prefix config...\n")
+		usage()
+		os.Exit(1)
+	}
+
+	verb := strings.ToLower(os.Args[1])
+	switch verb {
+	case "run", "revert", "append", "update", "estimate":
+	default:
+		os.Stderr.WriteString(fmt.Sprintf("factorize: unknown command %s\n\n", verb))
+		usage()
+		os.Exit(1)
+	}
+
+	opts := new(factorize.Options)
+	fs := flag.NewFlagSet(verb, flag.ExitOnError)
+	fs.Usage = usage
+	fs.StringVar(&opts.Order, "order", "count", "")
+	levels := fs.String("levels", "", "")
+	fs.Uint64Var(&opts.MinFreq, "minfreq", 0, "")
+	fs.IntVar(&opts.TopK, "topk", 0, "")
+	var normalize strlist
+	fs.Var(&normalize, "normalize", "")
+	fs.StringVar(&opts.SpillDir, "spill", "", "")
+	fs.StringVar(&opts.Descriptions, "descriptions", "", "")
+	groupfile := fs.String("groups", "", "")
+	fs.Parse(os.Args[2:])
+
+	checkorder(opts.Order)
+	if *levels != "" {
+		opts.Order = "list"
+		opts.Levels = readlevels(*levels)
+	}
+
+	if _, err := factorize.NewNormalizer(normalize); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("factorize: %v\n\n", err))
+		usage()
 		os.Exit(1)
 	}
+	opts.Normalize = normalize
+
+	// The groups are either given in a file, or as a comma
+	// separated list of prefixes, followed by the config files.
+	var specs []*groupspec
+	var cfiles []string
+	if *groupfile != "" {
+		specs = readgroups(*groupfile)
+		cfiles = fs.Args()
+	} else if fs.NArg() > 0 {
+		for _, px := range strings.Split(fs.Arg(0), ",") {
+			specs = append(specs, &groupspec{Prefix: px})
+		}
+		cfiles = fs.Args()[1:]
+	}
 
-	prefix := os.Args[2]
+	if len(specs) == 0 || len(cfiles) == 0 {
+		os.Stderr.WriteString("factorize: wrong number of arguments\n\n")
+		usage()
+		os.Exit(1)
+	}
 
-	if strings.HasSuffix(prefix, "*") {
-		multi = true
-		prefix = prefix[0 : len(prefix)-1]
+	// Check the options of all groups before changing anything.
+	gopts := make([]*factorize.Options, len(specs))
+	for j, sp := range specs {
+		gopts[j] = groupopts(opts, sp)
 	}
 
-	setupLogger(prefix)
+	appending = verb == "append"
 
-	for _, f := range os.Args[3:len(os.Args)] {
+	if len(specs) == 1 {
+		setupLogger(strings.TrimSuffix(specs[0].Prefix, "*"))
+	} else {
+		setupLogger("groups")
+	}
+	start := time.Now()
+
+	for _, f := range cfiles {
 		c := config.ReadConfig(f)
 		conf = append(conf, c)
 		logger.Printf("Read config file from %s", f)
 	}
 
-	files, vninfo := getfilenames(prefix)
-
-	if strings.ToLower(os.Args[1]) == "revert" {
-		logger.Printf("Reverting to string values")
-		revert(files)
-		logger.Printf("Done reverting")
-		os.Exit(0)
+	if verb != "estimate" {
+		lockall("factorize " + verb)
+		defer unlockall()
 	}
 
-	logger.Printf("Processing %d files with prefix %s + digit", len(files), prefix)
+	var groups []*factorize.Group
+	for j, sp := range specs {
+
+		prefix := sp.Prefix
+		multi = strings.HasSuffix(prefix, "*")
+		prefix = strings.TrimSuffix(prefix, "*")
 
-	codefile := prefix + "Codes.json"
-	codefile = path.Join(conf[0].CodesDir, codefile)
-	os.MkdirAll(conf[0].CodesDir, 0755)
+		files, vninfo := getfilenames(prefix)
+		logger.Printf("Found %d files with prefix %s", len(files), prefix)
 
-	factorize.Run(files, codefile, prefix, vninfo, logger)
+		o := gopts[j]
+
+		// The codes of existing data were assigned to normalized
+		// values, and rare values were collapsed, so new data
+		// must be coded the same way unless other options are
+		// given.
+		if appending || verb == "update" {
+			if cg := recordedGroup(vninfo); cg != nil {
+				if len(o.Normalize) == 0 {
+					o.Normalize = cg.Normalize
+				}
+				if o.MinFreq == 0 && o.TopK == 0 {
+					o.MinFreq = cg.MinFreq
+					o.TopK = cg.TopK
+				}
+			}
+		}
+
+		codefile := path.Join(conf[0].CodesDir, prefix+"Codes.json")
+
+		groups = append(groups, &factorize.Group{
+			Prefix:    prefix,
+			Files:     files,
+			CodesFile: codefile,
+			VarNames:  vninfo,
+			Options:   o,
+		})
+	}
+
+	switch verb {
+	case "estimate":
+		for _, g := range groups {
+			est, total := factorize.Estimate(g.Files, g.Options, logger)
+			fmt.Printf("%s: about %d distinct values among %d values in %d files\n", g.Prefix, est, total, len(g.Files))
+		}
+	case "revert":
+		logger.Printf("Reverting to string values")
+		for _, g := range groups {
+			revert(g)
+		}
+		logger.Printf("Done reverting")
+		updateManifests(start)
+	case "append":
+		factorize.ExtendGroups(groups, logger)
+	case "update":
+		factorize.UpdateGroups(groups, logger)
+		updateManifests(start)
+	case "run":
+		os.MkdirAll(conf[0].CodesDir, 0755)
+		factorize.RunGroups(groups, logger)
+		updateManifests(start)
+	}
 }
@@ -14,8 +14,10 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/golang/snappy"
+	"github.com/kshedden/gosascols/config"
 )
 
 const (
@@ -24,19 +26,77 @@ const (
 
 	// Limit length of token size to factorize
 	maxtok = 100
+
+	// The label of the code shared by the levels that are
+	// collapsed because they are rare.
+	OtherLabel = "__OTHER__"
 )
 
 // A function that is applied to each string value prior to integer
 // coding.
 type xfunc func(string) string
 
+// Options controls how the codes are assigned.  A nil *Options gives
+// the default options.
+type Options struct {
+
+	// The order in which codes are assigned to the levels:
+	// "count" (the default) assigns the lowest codes to the most
+	// frequent levels, "lexical" assigns codes in lexical order,
+	// "firstseen" assigns codes in the order that the levels
+	// first appear in the data, and "list" assigns codes in the
+	// order of Levels.  Ties are broken in lexical order.
+	Order string
+
+	// For Order "list", the levels in the order of their codes.
+	// Every listed level gets a code, even if it does not appear
+	// in the data.  Levels that are not listed get the following
+	// codes, in decreasing order of frequency.
+	Levels []string
+
+	// If positive, levels that occur fewer than MinFreq times are
+	// collapsed into a single level with label OtherLabel.
+	MinFreq uint64
+
+	// If positive, only the TopK most frequent levels get their
+	// own codes, and the other levels are collapsed into a single
+	// level with label OtherLabel.
+	TopK int
+
+	// The names of the normalizers applied to each value before
+	// it is coded, see NewNormalizer.
+	Normalize []string
+
+	// If not empty, the frequency counts of each file are written
+	// to disk in this directory, sorted by level, and merged, so
+	// that the counts for the individual files are not all held in
+	// memory.  Together with MinFreq, the rare levels are never
+	// held in memory.
+	SpillDir string
+
+	// If not empty, a csv file holding descriptions of the
+	// levels, which are saved in the codebook, see Codebook.
+	Descriptions string
+}
+
 var (
 	// Track the frequency of each string value
 	freq map[string]uint64
 
+	// The position where each string value first appears, used
+	// for Order "firstseen".  The file number is in the high 32
+	// bits and the line number is in the low 32 bits.
+	first map[string]uint64
+
 	// Maps string values to their integer codes
 	codes map[string]int
 
+	// The code of the collapsed rare levels, or -1 if there are no
+	// collapsed levels.
+	other int
+
+	opts *Options
+
 	// The file name where the json-formatted code information is
 	// written.
 	codesFile string
@@ -45,6 +105,9 @@ var (
 	// prior to integer coding.
 	xf xfunc
 
+	// Descriptions of the levels, read from opts.Descriptions
+	descriptions map[string]string
+
 	// Used to limit concurrency.
 	sem chan bool
 
@@ -58,8 +121,15 @@ func dofile(file string) {
 
 	logger.Printf("Processing %s", file)
 
+	// The original data are kept in origfile.  The file is
+	// replaced once all of the codes are written, so that it is
+	// never missing or partly written.
 	origfile := strings.Replace(file, ".bin.sz", "_string.bin.sz", 1)
-	err := os.Rename(file, origfile)
+	if _, err := os.Stat(origfile); err == nil {
+		msg := fmt.Sprintf("%s exists, revert the factorization or run the recover tool first\n", origfile)
+		panic(msg)
+	}
+	err := os.Link(file, origfile)
 	if err != nil {
 		panic(err)
 	}
@@ -73,13 +143,14 @@ func dofile(file string) {
 	rdr := snappy.NewReader(fid)
 
 	// Destination
-	out, err := os.Create(file)
+	out, err := config.CreateAtomic(file)
 	if err != nil {
 		panic(err)
 	}
-	defer out.Close()
+	defer out.Abort()
 	wtr := snappy.NewBufferedWriter(out)
-	defer wtr.Close()
+	cw := &config.ChecksumWriter{W: wtr}
+	cs := new(config.ColumnStats)
 
 	buf := make([]byte, 8)
 
@@ -94,12 +165,16 @@ func dofile(file string) {
 
 		c, ok := codes[tok]
 		if !ok {
-			panic("code not found")
+			if other < 0 {
+				panic("code not found")
+			}
+			c = other
 		}
 
 		m := binary.PutUvarint(buf, uint64(c))
+		cs.AddCode(uint64(c))
 
-		_, err := wtr.Write(buf[0:m])
+		_, err := cw.Write(buf[0:m])
 		if err != nil {
 			panic(err)
 		}
@@ -109,6 +184,18 @@ func dofile(file string) {
 		panic(err)
 	}
 
+	if err := wtr.Close(); err != nil {
+		panic(err)
+	}
+	if err := out.Commit(); err != nil {
+		panic(err)
+	}
+
+	d, f := path.Split(file)
+	config.SetChecksums(d, map[string]uint32{f: cw.Sum})
+	vn := strings.TrimSuffix(f, ".bin.sz")
+	config.SetStats(d, map[string]*config.ColumnStats{vn: cs})
+
 	logger.Printf("File: %s\nLen: %d\n", file, jj)
 }
 
@@ -127,13 +214,9 @@ func updateDtypes(files []string) {
 
 		fn := path.Join(dir, "dtypes.json")
 		nn := path.Join(dir, "dtypes_string.json")
-		err := os.Rename(fn, nn)
-		if err != nil {
-			panic(err)
-		}
 
 		// Read the current dtypes
-		fid, err := os.Open(nn)
+		fid, err := os.Open(fn)
 		if err != nil {
 			panic(err)
 		}
@@ -145,6 +228,10 @@ func updateDtypes(files []string) {
 		}
 		fid.Close()
 
+		// Keep the current types for reverting.  Both files are
+		// replaced atomically, so dtypes.json always exists.
+		config.WriteJSON(nn, dtypes)
+
 		// Modify the dtypes
 		for _, f := range fl {
 			v := strings.Split(f, ".")[0]
@@ -152,17 +239,20 @@ func updateDtypes(files []string) {
 		}
 
 		// Write the modified types back to disk
-		fid, err = os.Create(fn)
-		enc := json.NewEncoder(fid)
-		err = enc.Encode(dtypes)
-		if err != nil {
-			panic(err)
-		}
-		fid.Close()
+		config.WriteJSON(fn, dtypes)
 	}
 }
 
-func getfreqfile(file string, sem chan bool, rslt chan map[string]uint64) {
+// freqs are the frequencies of the values in one file, and their
+// first positions if needed.  In spill mode, the frequencies are in
+// the files named in runs instead.
+type freqs struct {
+	cnt   map[string]uint64
+	first map[string]uint64
+	runs  []string
+}
+
+func getfreqfile(file string, fnum int, sem chan bool, rslt chan *freqs) {
 
 	defer func() { <-sem }()
 
@@ -174,9 +264,15 @@ func getfreqfile(file string, sem chan bool, rslt chan map[string]uint64) {
 	rdr := snappy.NewReader(fid)
 
 	cnt := make(map[string]uint64)
+	var fst map[string]uint64
+	if opts.Order == "firstseen" {
+		fst = make(map[string]uint64)
+	}
+
+	var runs []string
 
 	scanner := bufio.NewScanner(rdr)
-	for scanner.Scan() {
+	for line := uint64(0); scanner.Scan(); line++ {
 		tok := scanner.Text()
 
 		if len(tok) > maxtok {
@@ -187,37 +283,66 @@ func getfreqfile(file string, sem chan bool, rslt chan map[string]uint64) {
 			tok = xf(tok)
 		}
 
+		if fst != nil && cnt[tok] == 0 {
+			fst[tok] = uint64(fnum)<<32 | line
+		}
 		cnt[tok] += 1
+
+		if spilldir != "" && len(cnt) >= spillmax {
+			runs = append(runs, writerun(cnt, fst))
+			cnt = make(map[string]uint64)
+			if fst != nil {
+				fst = make(map[string]uint64)
+			}
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
 		panic(err)
 	}
 
-	rslt <- cnt
+	if spilldir != "" {
+		if len(cnt) > 0 {
+			runs = append(runs, writerun(cnt, fst))
+		}
+		rslt <- &freqs{runs: runs}
+		return
+	}
+
+	rslt <- &freqs{cnt: cnt, first: fst}
 }
 
 func getfreq(files []string) {
 
 	sem := make(chan bool, concurrency)
-	rslt := make(chan map[string]uint64, 10)
+	rslt := make(chan *freqs, 10)
 	freq = make(map[string]uint64)
+	first = make(map[string]uint64)
 	hsem := make(chan bool, 1)
+	var runs []string
+
+	startspill()
 
 	// Harvesting goroutine
 	hsem <- true
 	go func() {
 		for r := range rslt {
-			for k, v := range r {
+			runs = append(runs, r.runs...)
+			for k, v := range r.cnt {
 				freq[k] += v
 			}
+			for k, p := range r.first {
+				if q, ok := first[k]; !ok || p < q {
+					first[k] = p
+				}
+			}
 		}
 		<-hsem
 	}()
 
-	for _, file := range files {
+	for j, file := range files {
 		sem <- true
-		go getfreqfile(file, sem, rslt)
+		go getfreqfile(file, j, sem, rslt)
 	}
 
 	for k := 0; k < concurrency; k++ {
@@ -225,10 +350,14 @@ func getfreq(files []string) {
 	}
 	close(rslt)
 
-	logger.Printf("Done calculating frequencies of %d codes\n", len(freq))
-
-	// Make sure the harvesting goroutine is done before the function exits
+	// Make sure the harvesting goroutine is done before merging
 	hsem <- true
+
+	if spilldir != "" {
+		mergefreq(runs)
+	}
+
+	logger.Printf("Done calculating frequencies of %d codes\n", len(freq)+rarelevels)
 }
 
 type frec struct {
@@ -236,111 +365,461 @@ type frec struct {
 	count uint64
 }
 
-type frecs []frec
+// orderlevels sorts the levels into the order in which they receive
+// codes, as determined by opts.Order.
+func orderlevels(fr []frec) {
+
+	// Position of each listed level
+	var lpos map[string]int
+	if opts.Order == "list" {
+		lpos = make(map[string]int)
+		for j, x := range opts.Levels {
+			lpos[x] = j
+		}
+	}
+
+	sort.Slice(fr, func(i, j int) bool {
+		a, b := fr[i], fr[j]
+		switch opts.Order {
+		case "lexical":
+			return a.code < b.code
+		case "firstseen":
+			if first[a.code] != first[b.code] {
+				return first[a.code] < first[b.code]
+			}
+			return a.code < b.code
+		case "list":
+			pa, oka := lpos[a.code]
+			pb, okb := lpos[b.code]
+			if oka && okb {
+				return pa < pb
+			} else if oka != okb {
+				return oka
+			}
+		}
+
+		// Frequency (descending), then lexical
+		if a.count != b.count {
+			return a.count > b.count
+		}
+		return a.code < b.code
+	})
+}
+
+// setopts sets the options, using the defaults if o is nil.
+func setopts(o *Options) {
+	if o == nil {
+		o = new(Options)
+	}
+	opts = o
+	if opts.Order == "" {
+		opts.Order = "count"
+	}
+
+	var err error
+	xf, err = NewNormalizer(opts.Normalize)
+	if err != nil {
+		panic(err)
+	}
+	if xf != nil {
+		logger.Printf("Normalizing values with %v", opts.Normalize)
+	}
+
+	// The descriptions are read before any data are changed, in
+	// case the file cannot be read.
+	descriptions = nil
+	if opts.Descriptions != "" {
+		descriptions = readDescriptions(opts.Descriptions)
+	}
+}
+
+// retain splits the levels into those that get their own codes and
+// those that are collapsed into the OtherLabel level, based on
+// opts.MinFreq and opts.TopK.  Listed levels are always retained.
+func retain(fr []frec) ([]frec, []frec) {
+
+	if opts.MinFreq == 0 && opts.TopK == 0 {
+		return fr, nil
+	}
 
-func (a frecs) Len() int           { return len(a) }
-func (a frecs) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a frecs) Less(i, j int) bool { return a[i].count < a[j].count }
+	if _, ok := freq[OtherLabel]; ok {
+		msg := fmt.Sprintf("The data contain the value %s, which is reserved for rare levels\n", OtherLabel)
+		panic(msg)
+	}
+
+	listed := make(map[string]bool)
+	for _, x := range opts.Levels {
+		listed[x] = true
+	}
+
+	// Consider the levels in order of decreasing frequency
+	byfreq := make([]frec, len(fr))
+	copy(byfreq, fr)
+	sort.Slice(byfreq, func(i, j int) bool {
+		if byfreq[i].count != byfreq[j].count {
+			return byfreq[i].count > byfreq[j].count
+		}
+		return byfreq[i].code < byfreq[j].code
+	})
+
+	var kept, rare []frec
+	var nk int
+	for _, f := range byfreq {
+		if listed[f.code] {
+			kept = append(kept, f)
+		} else if f.count >= opts.MinFreq && (opts.TopK == 0 || nk < opts.TopK) {
+			kept = append(kept, f)
+			nk++
+		} else {
+			rare = append(rare, f)
+		}
+	}
+
+	if n := len(rare) + rarelevels; n > 0 {
+		logger.Printf("Collapsing %d rare levels into %s", n, OtherLabel)
+	}
+
+	return kept, rare
+}
+
+// setother records the code of the collapsed rare levels.
+func setother() {
+	other = -1
+	if c, ok := codes[OtherLabel]; ok {
+		other = c
+	}
+}
 
 func getcodes() {
 
-	// Sort by frequency (descending)
 	var fr []frec
 	for k, v := range freq {
 		fr = append(fr, frec{code: k, count: v})
 	}
-	sort.Sort(sort.Reverse(frecs(fr)))
 
-	// Assign the integer codes so that the most frequent code
-	// gets the lowest integer code.
+	// Listed levels get codes even if they are not in the data.
+	for _, x := range opts.Levels {
+		if _, ok := freq[x]; !ok {
+			fr = append(fr, frec{code: x})
+		}
+	}
+
+	fr, rare := retain(fr)
+	orderlevels(fr)
+
+	// Assign the integer codes in order, so that by default the
+	// most frequent code gets the lowest integer code.  The rare
+	// levels share the last code.
 	codes = make(map[string]int)
 	for j, f := range fr {
 		codes[f.code] = j
 	}
+	if len(rare) > 0 || rarelevels > 0 {
+		codes[OtherLabel] = len(fr)
+		fr = append(fr, frec{code: OtherLabel})
+	}
+	setother()
+
+	writefreq(fr)
+}
+
+// writefreq saves the frequencies of the levels, in the order given.
+// The count for OtherLabel is the total count of the collapsed
+// levels.  The collapsed levels follow, with their counts and the
+// label OtherLabel in a third column.  In spill mode, the collapsed
+// levels that were not held in memory are last, in lexical order.
+func writefreq(fr []frec) {
+
+	// The levels in the data that do not have their own code
+	var rare []frec
+	for k, v := range freq {
+		if _, ok := codes[k]; !ok {
+			rare = append(rare, frec{code: k, count: v})
+		}
+	}
+	nrare := othercount()
+	sort.Slice(rare, func(i, j int) bool {
+		if rare[i].count != rare[j].count {
+			return rare[i].count > rare[j].count
+		}
+		return rare[i].code < rare[j].code
+	})
 
-	// Save the frequencies
 	fn := strings.Replace(codesFile, ".json", "_freq.csv", 1)
 	fid, err := os.Create(fn)
 	if err != nil {
 		panic(err)
 	}
 	defer fid.Close()
+	wtr := bufio.NewWriter(fid)
+	defer wtr.Flush()
 	for _, f := range fr {
-		s := fmt.Sprintf("%s,%d\n", f.code, f.count)
-		_, err := fid.Write([]byte(s))
+		n := f.count
+		if f.code == OtherLabel {
+			n = nrare
+		}
+		_, err := fmt.Fprintf(wtr, "%s,%d\n", f.code, n)
 		if err != nil {
 			panic(err)
 		}
 	}
+	for _, f := range rare {
+		_, err := fmt.Fprintf(wtr, "%s,%d,%s\n", f.code, f.count, OtherLabel)
+		if err != nil {
+			panic(err)
+		}
+	}
+	copyrare(wtr)
 }
 
-// Save the factor code/label associations.
-func writeCodes() {
-	logger.Printf("Writing %d code/label associations to %s...", len(codes), codesFile)
-	fid, err := os.Create(codesFile)
+// readCodes loads existing factor code/label associations from
+// codesFile.
+func readCodes() {
+	logger.Printf("Reading code/label associations from %s...", codesFile)
+	fid, err := os.Open(codesFile)
 	if err != nil {
 		panic(err)
 	}
 	defer fid.Close()
-	enc := json.NewEncoder(fid)
-	err = enc.Encode(codes)
+	codes = make(map[string]int)
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(&codes)
 	if err != nil {
 		panic(err)
 	}
+	logger.Printf("Read %d code/label associations", len(codes))
+}
+
+// extendcodes assigns codes to all levels that do not already have a
+// code, and returns the number of new codes.  The new codes follow
+// the existing codes, in the order given by opts.Order.
+func extendcodes() int {
+
+	var fr []frec
+	for k, v := range freq {
+		if _, ok := codes[k]; !ok {
+			fr = append(fr, frec{code: k, count: v})
+		}
+	}
+	for _, x := range opts.Levels {
+		if _, ok := codes[x]; !ok && freq[x] == 0 {
+			fr = append(fr, frec{code: x})
+		}
+	}
+	fr, rare := retain(fr)
+	orderlevels(fr)
+
+	// The existing codes are not necessarily contiguous.
+	next := 0
+	for _, c := range codes {
+		if c >= next {
+			next = c + 1
+		}
+	}
+
+	for j, f := range fr {
+		codes[f.code] = next + j
+	}
+
+	// Rare new levels use the existing code for rare levels if
+	// there is one.
+	nnew := len(fr)
+	if _, ok := codes[OtherLabel]; (len(rare) > 0 || rarelevels > 0) && !ok {
+		codes[OtherLabel] = next + len(fr)
+		nnew++
+	}
+	setother()
+
+	logger.Printf("Added codes for %d new levels", nnew)
+
+	return nnew
+}
+
+// CodesMeta describes the factor codes in a codes file.  It is
+// stored alongside the codes file, with the suffix _meta.json.
+type CodesMeta struct {
+
+	// The version of the codes, incremented each time that codes
+	// are added or reassigned.
+	Version int
+
+	// The number of levels that have codes
+	Levels int
+
+	// The time that the codes were last changed
+	Updated time.Time
+}
+
+func metaFile(codesfile string) string {
+	return strings.Replace(codesfile, ".json", "_meta.json", 1)
+}
+
+// ReadCodesMeta returns the description of the codes in the given
+// codes file.  The version is zero if the codes have no description.
+func ReadCodesMeta(codesfile string) *CodesMeta {
+
+	meta := new(CodesMeta)
+
+	fid, err := os.Open(metaFile(codesfile))
+	if os.IsNotExist(err) {
+		return meta
+	} else if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(meta)
+	if err != nil {
+		panic(err)
+	}
+
+	return meta
+}
+
+// writeMeta increments the version of the codes and saves their
+// description.
+func writeMeta() {
+
+	meta := ReadCodesMeta(codesFile)
+	meta.Version++
+	meta.Levels = len(codes)
+	meta.Updated = time.Now()
+
+	config.WriteJSON(metaFile(codesFile), meta)
+
+	logger.Printf("Codes in %s are now version %d", codesFile, meta.Version)
+}
+
+// Save the factor code/label associations.
+func writeCodes() {
+	logger.Printf("Writing %d code/label associations to %s...", len(codes), codesFile)
+	config.WriteJSON(codesFile, codes)
 	logger.Printf("Done")
 }
 
-func writeVname(vninfo map[string][]string, prefix string) {
+func writeVname(g *Group) {
+
+	o := g.Options
+	if o == nil {
+		o = new(Options)
+	}
 
 	// Why are these files written to multiple directories?
-	for pa, vnames := range vninfo {
+	for pa, vnames := range g.VarNames {
 
 		prefile := path.Join(pa, "CodeGroups.json")
 		logger.Printf("Updating variable name/code prefixes in %s", prefile)
 
-		// Get the current map if it exists
-		mp := make(map[string]string)
-		_, err := os.Stat(prefile)
-		if !os.IsNotExist(err) {
-			rdr, err := os.Open(prefile)
-			if err != nil {
-				panic(err)
-			}
-			dec := json.NewDecoder(rdr)
-			err = dec.Decode(&mp)
-			if err != nil {
-				panic(err)
-			}
-		}
-
-		// Add the new code group information
+		// Add the new code group information to the current
+		// information, if any.
+		mp := config.ReadCodeGroupFile(prefile)
 		for _, v := range vnames {
-			mp[v] = prefix
+			mp[v] = &config.CodeGroup{Prefix: g.Prefix, Normalize: o.Normalize, MinFreq: o.MinFreq, TopK: o.TopK}
 		}
 
-		// Rewrite the file
-		fid, err := os.Create(prefile)
-		if err != nil {
-			panic(err)
-		}
-		defer fid.Close()
-		enc := json.NewEncoder(fid)
-		err = enc.Encode(mp)
-		if err != nil {
-			panic(err)
-		}
+		config.WriteCodeGroupFile(prefile, mp)
 	}
 }
 
-func Run(files []string, codesfile string, prefix string, vninfo map[string][]string, lgr *log.Logger) {
+// Group is a group of variables that are factorized together, so
+// that they share one set of codes.
+type Group struct {
+
+	// The variables in the group have names starting with Prefix.
+	Prefix string
+
+	// The column files of the variables in the group
+	Files []string
+
+	// The file holding the codes of the group
+	CodesFile string
+
+	// The names of the variables in the group, for each dataset
+	// directory
+	VarNames map[string][]string
+
+	// The options used to assign the codes, may be nil.
+	Options *Options
+
+	// The codebook of the group, which is saved once the dtypes
+	// are updated
+	codebook *Codebook
+}
+
+// RunGroups factorizes several groups of variables.  The groups are
+// processed one at a time, so that the memory needed to count the
+// values is that of the largest group, but the dtypes of each bucket
+// are only updated once, after all groups have been converted.
+func RunGroups(groups []*Group, lgr *log.Logger) {
 
 	logger = lgr
+	checkgroups(groups)
+
+	var files []string
+	for _, g := range groups {
+		rungroup(g)
+		files = append(files, g.Files...)
+	}
+
+	updateDtypes(files)
+
+	// The groups are recorded once their variables are
+	// factorized in every bucket, since an interrupted command is
+	// undone by the recover tool.
+	for _, g := range groups {
+		writeCodebook(g)
+		writeVname(g)
+	}
+
+	logger.Printf("All done, exiting")
+}
+
+// checkgroups panics if a file belongs to more than one group, since
+// the file would be converted twice, and its string values lost.
+func checkgroups(groups []*Group) {
+	owner := make(map[string]string)
+	for _, g := range groups {
+		for _, f := range g.Files {
+			if p, ok := owner[f]; ok {
+				msg := fmt.Sprintf("%s is in the groups with prefixes %s and %s\n", f, p, g.Prefix)
+				panic(msg)
+			}
+			owner[f] = g.Prefix
+		}
+	}
+}
+
+func rungroup(g *Group) {
+
+	logger.Printf("Factorizing %d files with prefix %s", len(g.Files), g.Prefix)
+
+	setopts(g.Options)
 	sem = make(chan bool, concurrency)
-	codesFile = codesfile
+	codesFile = g.CodesFile
+	defer cleanspill()
 
-	getfreq(files)
+	getfreq(g.Files)
 	getcodes()
 
+	convert(g.Files)
+
+	writeCodes()
+	writeMeta()
+	g.codebook = makeCodebook(g.Prefix, sources(g), "run")
+}
+
+// sources returns the dataset directories of a group.
+func sources(g *Group) []string {
+	var s []string
+	for pa := range g.VarNames {
+		s = append(s, pa)
+	}
+	return s
+}
+
+// convert factorizes the given files using the current codes.
+func convert(files []string) {
+
 	for _, file := range files {
 		sem <- true
 		go dofile(file)
@@ -349,11 +828,118 @@ func Run(files []string, codesfile string, prefix string, vninfo map[string][]st
 		sem <- true
 	}
 	logger.Printf("Finished conversions")
+}
+
+// UpdateGroups factorizes several groups of variables using the codes
+// already stored in the codes file of each group, which are not
+// changed.  New codes are added for levels that are not present in
+// the codes file, so that the codes are stable across releases of a
+// dataset.  As with RunGroups, the dtypes of each bucket are only
+// updated once.
+func UpdateGroups(groups []*Group, lgr *log.Logger) {
+
+	logger = lgr
+	checkgroups(groups)
+
+	var files []string
+	for _, g := range groups {
+		updategroup(g)
+		files = append(files, g.Files...)
+	}
 
 	updateDtypes(files)
 
-	writeCodes()
-	writeVname(vninfo, prefix)
+	// The groups are recorded once their variables are
+	// factorized in every bucket, since an interrupted command is
+	// undone by the recover tool.
+	for _, g := range groups {
+		writeCodebook(g)
+		writeVname(g)
+	}
 
 	logger.Printf("All done, exiting")
 }
+
+func updategroup(g *Group) {
+
+	logger.Printf("Updating %d files with prefix %s", len(g.Files), g.Prefix)
+
+	setopts(g.Options)
+	sem = make(chan bool, concurrency)
+	codesFile = g.CodesFile
+	defer cleanspill()
+
+	readCodes()
+	getfreq(g.Files)
+	nnew := extendcodes()
+
+	// Save the frequencies in code order, including levels that
+	// are not in the current data.
+	levels := make([]string, 0, len(codes))
+	for k := range codes {
+		levels = append(levels, k)
+	}
+	sort.Slice(levels, func(i, j int) bool { return codes[levels[i]] < codes[levels[j]] })
+	fr := make([]frec, len(levels))
+	for i, k := range levels {
+		fr[i] = frec{code: k, count: freq[k]}
+	}
+	writefreq(fr)
+
+	convert(g.Files)
+
+	if nnew > 0 {
+		writeCodes()
+		writeMeta()
+	}
+	g.codebook = makeCodebook(g.Prefix, sources(g), "update")
+}
+
+// ExtendGroups factorizes several groups of variables using the codes
+// already stored in the codes file of each group, adding new codes
+// for levels that are not present in the codes file.  This is used to
+// factorize data that are being appended to a factorized dataset.  As
+// with RunGroups, the dtypes of each bucket are only updated once.
+func ExtendGroups(groups []*Group, lgr *log.Logger) {
+
+	logger = lgr
+	checkgroups(groups)
+
+	var files []string
+	for _, g := range groups {
+		extendgroup(g)
+		files = append(files, g.Files...)
+	}
+
+	updateDtypes(files)
+
+	// As in RunGroups, the counts are only added to the codebooks
+	// once the staged data are factorized.
+	for _, g := range groups {
+		writeCodebook(g)
+	}
+
+	logger.Printf("All done, exiting")
+}
+
+func extendgroup(g *Group) {
+
+	logger.Printf("Extending codes for %d files with prefix %s", len(g.Files), g.Prefix)
+
+	setopts(g.Options)
+	sem = make(chan bool, concurrency)
+	codesFile = g.CodesFile
+	defer cleanspill()
+
+	readCodes()
+	getfreq(g.Files)
+	nnew := extendcodes()
+
+	convert(g.Files)
+
+	if nnew > 0 {
+		writeCodes()
+		writeMeta()
+	}
+	g.codebook = makeCodebook(g.Prefix, nil, "extend")
+}
@@ -0,0 +1,100 @@
+package factorize
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// NewNormalizer returns a function that applies the named
+// normalizers to a value, in the given order.  The normalizers are:
+//
+//	trim        remove leading and trailing white space
+//	upper       convert to upper case
+//	strippunct  remove punctuation
+//	icd         remove the dots from ICD codes, e.g. 250.01 -> 25001
+//	zeropad:W   pad with leading zeros to width W
+//	regex:P:R   replace matches of the regular expression P with R,
+//	            R may refer to submatches as in regexp.Expand
+//
+// If no normalizers are given, the function is nil.
+func NewNormalizer(names []string) (func(string) string, error) {
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	var fl []func(string) string
+	for _, na := range names {
+		f, err := normalizer(na)
+		if err != nil {
+			return nil, err
+		}
+		fl = append(fl, f)
+	}
+
+	return func(x string) string {
+		for _, f := range fl {
+			x = f(x)
+		}
+		return x
+	}, nil
+}
+
+// normalizer returns the normalizer with the given name.
+func normalizer(name string) (func(string) string, error) {
+
+	switch name {
+	case "trim":
+		return strings.TrimSpace, nil
+	case "upper":
+		return strings.ToUpper, nil
+	case "strippunct":
+		return func(x string) string {
+			return strings.Map(func(r rune) rune {
+				if unicode.IsPunct(r) {
+					return -1
+				}
+				return r
+			}, x)
+		}, nil
+	case "icd":
+		return func(x string) string {
+			return strings.Replace(x, ".", "", -1)
+		}, nil
+	}
+
+	switch {
+	case strings.HasPrefix(name, "zeropad:"):
+		w, err := strconv.Atoi(name[len("zeropad:"):])
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid width in normalizer %s", name)
+		}
+		return func(x string) string {
+			if len(x) >= w {
+				return x
+			}
+			return strings.Repeat("0", w-len(x)) + x
+		}, nil
+	case strings.HasPrefix(name, "regex:"):
+		// The replacement follows the last colon, so that the
+		// pattern may contain colons.
+		s := name[len("regex:"):]
+		i := strings.LastIndex(s, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("normalizer %s should have the form regex:pattern:replacement", name)
+		}
+		re, err := regexp.Compile(s[0:i])
+		if err != nil {
+			return nil, fmt.Errorf("in normalizer %s: %v", name, err)
+		}
+		repl := s[i+1:]
+		return func(x string) string {
+			return re.ReplaceAllString(x, repl)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown normalizer %s", name)
+}
@@ -0,0 +1,222 @@
+package factorize
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/kshedden/gosascols/config"
+)
+
+// ReadLabels returns a map from the codes in a codes file to their
+// labels.  Codes that are not used are not in the map, so that the
+// empty string can be a label.
+func ReadLabels(codesfile string) map[int]string {
+
+	fid, err := os.Open(codesfile)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	cm := make(map[string]int)
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(&cm)
+	if err != nil {
+		panic(err)
+	}
+
+	labels := make(map[int]string)
+	for k, c := range cm {
+		labels[c] = k
+	}
+
+	return labels
+}
+
+// readcodecol returns the codes in a factorized column file.
+func readcodecol(file string) []uint64 {
+
+	fid, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	rdr := bufio.NewReader(snappy.NewReader(fid))
+
+	var x []uint64
+	for {
+		c, err := binary.ReadUvarint(rdr)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			panic(err)
+		}
+		x = append(x, c)
+	}
+
+	return x
+}
+
+// readstrcol returns the values in a string column file.
+func readstrcol(file string) []string {
+
+	fid, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	var x []string
+	scanner := bufio.NewScanner(snappy.NewReader(fid))
+	for scanner.Scan() {
+		x = append(x, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return x
+}
+
+// insync returns true if the original string values in orig give the
+// codes in x, in the same order.  This checks that the backup belongs
+// to the column, but cannot detect rows that were reordered, since
+// many values may share a code.  sortbuckets reorders the backups
+// with the rows.
+func insync(orig []string, x []uint64, labels map[int]string, xf func(string) string) bool {
+
+	if len(orig) != len(x) {
+		return false
+	}
+
+	cm := make(map[string]uint64)
+	for c, k := range labels {
+		cm[k] = uint64(c)
+	}
+	oc, hasother := cm[OtherLabel]
+
+	for i, s := range orig {
+		if xf != nil {
+			s = xf(s)
+		}
+		c, ok := cm[s]
+		if !ok {
+			if !hasother {
+				return false
+			}
+			c = oc
+		}
+		if c != x[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RevertColumn replaces a factorized column file with its string
+// values, given the labels of its codes and the names of the
+// normalizers that were applied before coding.
+//
+// If the backup of the original string values made by factorize
+// matches the codes row for row, the original values are restored.
+// sortbuckets reorders the backups with the rows, so they remain in
+// the order of the codes.  Otherwise, e.g. if data were appended to
+// the bucket since it was factorized, or the backup was removed by
+// cleanbuckets, the codes are replaced by their labels.  The labels
+// are the normalized values, and values that were collapsed into a
+// single code have label OtherLabel.  RevertColumn returns true if
+// the original values were restored.
+func RevertColumn(file string, labels map[int]string, normalize []string) bool {
+
+	vals, sum, restored := revertfile(file, labels, normalize)
+
+	d, f := path.Split(file)
+	config.SetChecksums(d, map[string]uint32{f: sum})
+	vn := strings.TrimSuffix(f, ".bin.sz")
+	config.SetStats(d, map[string]*config.ColumnStats{vn: config.StringStats(vals)})
+
+	return restored
+}
+
+// RevertBackup is like RevertColumn, for the backup of a factorized
+// column that sortbuckets keeps in the orig directory of a bucket,
+// so that the backup can still replace the column once it holds
+// strings again.  The backups have no checksums or statistics.
+func RevertBackup(file string, labels map[int]string, normalize []string) bool {
+	_, _, restored := revertfile(file, labels, normalize)
+	return restored
+}
+
+// revertfile replaces a factorized column file with its string
+// values, as described for RevertColumn.  It returns the values, the
+// checksum of the new file, and whether the original values were
+// restored.
+func revertfile(file string, labels map[int]string, normalize []string) ([]string, uint32, bool) {
+
+	xf, err := NewNormalizer(normalize)
+	if err != nil {
+		panic(err)
+	}
+
+	x := readcodecol(file)
+
+	origfile := strings.Replace(file, ".bin.sz", "_string.bin.sz", 1)
+	var vals []string
+	var restored bool
+	if _, err := os.Stat(origfile); err == nil {
+		orig := readstrcol(origfile)
+		if insync(orig, x, labels, xf) {
+			vals = orig
+			restored = true
+		}
+	}
+
+	if !restored {
+		vals = make([]string, len(x))
+		for i, c := range x {
+			k, ok := labels[int(c)]
+			if !ok {
+				msg := fmt.Sprintf("%s contains code %d, which is not in the codes file\n", file, c)
+				panic(msg)
+			}
+			vals[i] = k
+		}
+	}
+
+	out, err := config.CreateAtomic(file)
+	if err != nil {
+		panic(err)
+	}
+	defer out.Abort()
+	wtr := snappy.NewBufferedWriter(out)
+	cw := &config.ChecksumWriter{W: wtr}
+	for _, v := range vals {
+		if _, err := io.WriteString(cw, v); err != nil {
+			panic(err)
+		}
+		if _, err := cw.Write([]byte("\n")); err != nil {
+			panic(err)
+		}
+	}
+	if err := wtr.Close(); err != nil {
+		panic(err)
+	}
+	if err := out.Commit(); err != nil {
+		panic(err)
+	}
+
+	err = os.Remove(origfile)
+	if err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+
+	return vals, cw.Sum, restored
+}
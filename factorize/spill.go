@@ -0,0 +1,321 @@
+package factorize
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	// In spill mode, the counts for a file are written to disk
+	// whenever this many distinct levels are held in memory.
+	spillmax = 1 << 20
+
+	// The maximum number of spilled files that are merged at once.
+	maxopen = 200
+)
+
+var (
+	// The directory holding the spilled counts, empty unless
+	// spilling.
+	spilldir string
+
+	// The number of spilled files written so far, used to name
+	// the files.
+	nruns int64
+
+	// In spill mode, levels that occur fewer than opts.MinFreq
+	// times are written to rarefile while merging, rather than
+	// being held in freq.  rarelevels and rarecount are the number
+	// of these levels and their total count.
+	rarefile   string
+	rarelevels int
+	rarecount  uint64
+)
+
+// writerun writes counts and first positions to a new file in
+// spilldir, sorted by level, and returns the file name.  The file
+// contains one record per level: the length of the level, the
+// level, its count, and its first position, with integers stored as
+// uvarints.
+func writerun(cnt, fst map[string]uint64) string {
+
+	levels := make([]string, 0, len(cnt))
+	for k := range cnt {
+		levels = append(levels, k)
+	}
+	sort.Strings(levels)
+
+	w := newrunwriter()
+	for _, k := range levels {
+		w.write(k, cnt[k], fst[k])
+	}
+
+	return w.close()
+}
+
+type runwriter struct {
+	fname string
+	fid   *os.File
+	wtr   *snappy.Writer
+	buf   []byte
+}
+
+func newrunwriter() *runwriter {
+
+	n := atomic.AddInt64(&nruns, 1)
+	fname := path.Join(spilldir, fmt.Sprintf("run%06d.sz", n))
+	fid, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+
+	return &runwriter{
+		fname: fname,
+		fid:   fid,
+		wtr:   snappy.NewBufferedWriter(fid),
+		buf:   make([]byte, 3*binary.MaxVarintLen64),
+	}
+}
+
+func (w *runwriter) write(level string, count, first uint64) {
+
+	m := binary.PutUvarint(w.buf, uint64(len(level)))
+	if _, err := w.wtr.Write(w.buf[0:m]); err != nil {
+		panic(err)
+	}
+	if _, err := io.WriteString(w.wtr, level); err != nil {
+		panic(err)
+	}
+	m = binary.PutUvarint(w.buf, count)
+	m += binary.PutUvarint(w.buf[m:], first)
+	if _, err := w.wtr.Write(w.buf[0:m]); err != nil {
+		panic(err)
+	}
+}
+
+func (w *runwriter) close() string {
+	if err := w.wtr.Close(); err != nil {
+		panic(err)
+	}
+	if err := w.fid.Close(); err != nil {
+		panic(err)
+	}
+	return w.fname
+}
+
+// runreader reads the records of a spilled file in order.
+type runreader struct {
+	fid   *os.File
+	rdr   *bufio.Reader
+	level string
+	count uint64
+	first uint64
+}
+
+func newrunreader(fname string) *runreader {
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	return &runreader{fid: fid, rdr: bufio.NewReader(snappy.NewReader(fid))}
+}
+
+// next reads the next record, returning false at the end of the
+// file.
+func (r *runreader) next() bool {
+
+	n, err := binary.ReadUvarint(r.rdr)
+	if err == io.EOF {
+		r.fid.Close()
+		return false
+	} else if err != nil {
+		panic(err)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.rdr, b); err != nil {
+		panic(err)
+	}
+	r.level = string(b)
+
+	if r.count, err = binary.ReadUvarint(r.rdr); err != nil {
+		panic(err)
+	}
+	if r.first, err = binary.ReadUvarint(r.rdr); err != nil {
+		panic(err)
+	}
+
+	return true
+}
+
+// runheap orders the readers by their current level.
+type runheap []*runreader
+
+func (h runheap) Len() int            { return len(h) }
+func (h runheap) Less(i, j int) bool  { return h[i].level < h[j].level }
+func (h runheap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runheap) Push(x interface{}) { *h = append(*h, x.(*runreader)) }
+func (h *runheap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[0 : len(old)-1]
+	return r
+}
+
+// mergeruns merges spilled files, calling emit once for each level in
+// sorted order, with the total count of the level and its first
+// position.  The files are removed after they are merged.
+func mergeruns(runs []string, emit func(string, uint64, uint64)) {
+
+	var h runheap
+	for _, fn := range runs {
+		r := newrunreader(fn)
+		if r.next() {
+			h = append(h, r)
+		}
+	}
+	heap.Init(&h)
+
+	for len(h) > 0 {
+		level := h[0].level
+		var count uint64
+		first := h[0].first
+		for len(h) > 0 && h[0].level == level {
+			r := h[0]
+			count += r.count
+			if r.first < first {
+				first = r.first
+			}
+			if r.next() {
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+		emit(level, count, first)
+	}
+
+	for _, fn := range runs {
+		if err := os.Remove(fn); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// mergefreq merges the spilled counts into freq and first.  If
+// opts.MinFreq is set, levels that are certain to be collapsed are
+// written to rarefile instead, so that they are never held in memory.
+func mergefreq(runs []string) {
+
+	logger.Printf("Merging %d spilled files", len(runs))
+
+	// Limit the number of open files by merging in stages.
+	for len(runs) > maxopen {
+		w := newrunwriter()
+		mergeruns(runs[0:maxopen], w.write)
+		runs = append(runs[maxopen:], w.close())
+	}
+
+	listed := make(map[string]bool)
+	for _, x := range opts.Levels {
+		listed[x] = true
+	}
+
+	rarefile = path.Join(spilldir, "rare.csv")
+	fid, err := os.Create(rarefile)
+	if err != nil {
+		panic(err)
+	}
+	wtr := bufio.NewWriter(fid)
+
+	mergeruns(runs, func(level string, count, pos uint64) {
+
+		// Levels that already have codes are always kept.
+		_, hascode := codes[level]
+
+		if count < opts.MinFreq && !listed[level] && !hascode {
+			if level == OtherLabel {
+				msg := fmt.Sprintf("The data contain the value %s, which is reserved for rare levels\n", OtherLabel)
+				panic(msg)
+			}
+			if _, err := fmt.Fprintf(wtr, "%s,%d,%s\n", level, count, OtherLabel); err != nil {
+				panic(err)
+			}
+			rarelevels++
+			rarecount += count
+			return
+		}
+
+		freq[level] = count
+		if opts.Order == "firstseen" {
+			first[level] = pos
+		}
+	})
+
+	if err := wtr.Flush(); err != nil {
+		panic(err)
+	}
+	if err := fid.Close(); err != nil {
+		panic(err)
+	}
+
+	if rarelevels > 0 {
+		logger.Printf("%d rare levels were not held in memory", rarelevels)
+	}
+}
+
+// copyrare appends the rare levels found while merging to w.
+func copyrare(w io.Writer) {
+
+	if rarefile == "" {
+		return
+	}
+
+	fid, err := os.Open(rarefile)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	if _, err := io.Copy(w, fid); err != nil {
+		panic(err)
+	}
+}
+
+// startspill creates the directory for the spilled counts within
+// opts.SpillDir, if spilling is requested.
+func startspill() {
+
+	spilldir = ""
+	rarefile = ""
+	rarelevels = 0
+	rarecount = 0
+
+	if opts.SpillDir == "" {
+		return
+	}
+
+	var err error
+	spilldir, err = ioutil.TempDir(opts.SpillDir, "factorize")
+	if err != nil {
+		panic(err)
+	}
+	logger.Printf("Spilling frequency counts to %s", spilldir)
+}
+
+// cleanspill removes the spilled counts.
+func cleanspill() {
+	if spilldir != "" {
+		os.RemoveAll(spilldir)
+	}
+}
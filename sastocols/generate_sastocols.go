@@ -34,15 +34,19 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"hash/adler32"
 	"io"
 	"log"
+	"math"
+	"math/rand"
 	"os"
 	"path"
 	"sync"
+	"sync/atomic"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/kshedden/gosascols/config"
 	"github.com/kshedden/datareader"
@@ -53,21 +57,40 @@ var (
     // Needed to avoid errrors if no other references are made to these packages.
     _ = strings.TrimSpace
 	_ = strconv.Atoi
+	_ = errors.Is
 
     conf *config.Config
 
-	rslt_chan chan *rec
+	// Batches of records are sent to the writers on these
+	// channels, writer w handles the buckets k with k % Writers
+	// == w.
+	wchans []chan *batch
 
     // Later replace triple " with back ticks
     dtypes = """{{ .Dtypes }}"""
 
 	wg  sync.WaitGroup
-	hwg sync.WaitGroup
+	wwg sync.WaitGroup
 
 	sem chan bool
 
 	buckets []*Bucket
 
+	// The total number of bytes held in the bucket buffers
+	buffered int64
+
+	// Only one goroutine at a time flushes buckets to stay within
+	// the memory budget.
+	bmut sync.Mutex
+
+	// Information about the SAS files for the manifest
+	sources []*config.SourceInfo
+	smut    sync.Mutex
+
+	// Conversion reports for the SAS files
+	reports map[string]*config.FileReport
+	rmut    sync.Mutex
+
 	logger *log.Logger
 )
 
@@ -82,43 +105,68 @@ func setupLogger() {
 	logger = log.New(fid, "", log.Ltime)
 }
 
-// harvest retrieves data from the producers in the form of data
-// records, and adds each record to the appropriate bucket.
-func harvest() {
-
-	ha := adler32.New()
-
-	buf := make([]byte, 8)
+// batch contains the converted rows of a chunk, ordered by bucket.
+// The rows for bucket k are in positions start[k] to start[k+1]-1 of
+// the segment.  Each writer reads the rows for its own buckets.
+type batch struct {
+	seg   *segment
+	start []int
+}
 
-	for r := range rslt_chan {
+// writer adds the rows it receives to its buckets.  A bucket is
+// flushed by its writer when it is full, so the other writers are
+// not stalled while the data are written to disk.
+func writer(w int) {
 
-		binary.LittleEndian.PutUint64(buf, r.{{ .KeyVar }})
-		ha.Reset()
-		_, err := ha.Write(buf)
-		if err != nil {
-			panic(err)
+	for b := range wchans[w] {
+		for k := w; k < int(conf.NumBuckets); k += conf.Writers {
+			if b.start[k+1] > b.start[k] {
+				buckets[k].Add(b.seg, b.start[k], b.start[k+1])
+			}
 		}
-
-		bucket := int(ha.Sum32() % conf.NumBuckets)
-		buckets[bucket].Add(r)
 	}
 
-	hwg.Done()
+	wwg.Done()
 }
 
-// sendrecs drains a chunk, sending each record in the chunk to be
-// harvested.
+// sendrecs converts a chunk, and sends the converted rows to the
+// writers.  The rows are hashed and grouped by bucket here, so that
+// this work is done in parallel.
 func sendrecs(c *chunk) {
 
 	defer func() { <-sem; wg.Done() }()
 
-	for {
-		r := c.nextrec()
-		if r == nil {
-			break
-		}
-		rslt_chan <- r
+	c.summarize()
+	seg := c.convert()
+
+	// Sort the rows by bucket (a counting sort)
+	nb := int(conf.NumBuckets)
+	bkts := make([]int, len(seg.{{ .KeyVar }}))
+	start := make([]int, nb+1)
+	for i, x := range seg.{{ .KeyVar }} {
+		k := config.Bucket(x, conf)
+		bkts[i] = k
+		start[k+1]++
+	}
+	for k := 1; k <= nb; k++ {
+		start[k] += start[k-1]
 	}
+	pos := make([]int, nb)
+	copy(pos, start)
+	perm := make([]int, len(bkts))
+	for i, k := range bkts {
+		perm[pos[k]] = i
+		pos[k]++
+	}
+
+	b := &batch{seg: seg.permute(perm), start: start}
+	for w := 0; w < conf.Writers; w++ {
+		wchans[w] <- b
+	}
+
+	rmut.Lock()
+	reports[c.file].Merge(c.rpt)
+	rmut.Unlock()
 }
 
 // dofile processes one SAS file.
@@ -142,6 +190,19 @@ func dofile(filename string) {
 
 	logger.Printf("%s has %d rows", filename, sas.RowCount())
 
+	fi, err := fid.Stat()
+	if err != nil {
+		panic(err)
+	}
+	smut.Lock()
+	sources = append(sources, &config.SourceInfo{File: filename, Size: fi.Size(),
+		ModTime: fi.ModTime(), Rows: sas.RowCount()})
+	smut.Unlock()
+
+	rmut.Lock()
+	reports[filename] = config.NewFileReport(filename)
+	rmut.Unlock()
+
 	cm := make(map[string]int)
 	for k, na := range sas.ColumnNames() {
 		cm[na] = k
@@ -156,6 +217,8 @@ func dofile(filename string) {
 		}
 
 		chunk := new(chunk)
+		chunk.file = filename
+		chunk.rpt = config.NewFileReport(filename)
 
 		data, err := sas.Read(int(conf.SASChunkSize))
 		if data == nil {
@@ -177,23 +240,30 @@ func dofile(filename string) {
 	}
 }
 
-// nextrec finds the next valid record from the chunk and returns it.
-// recs with missing KeyVar values are skipped, so this may not
-// return a value for every row of the SAS file chunk.  Returns nil
-// when the chunk is fully processed.
-func (c *chunk) nextrec() *rec {
+// convert returns the converted values of the rows of the chunk.
+// Rows with missing KeyVar values, or that do not satisfy the filter
+// expression, are skipped, so the segment may not contain every row
+// of the SAS file chunk.
+func (c *chunk) convert() *segment {
 
-	for {
-		rec, cont := c.trynextrec()
-		if rec != nil {
-			return rec
-		}
-		if !cont {
-			break
+	n := len(c.{{ .KeyVar }})
+	seg := new(segment)
+    {{- range .Columns }}
+        seg.{{ .Name }} = make([]{{ .GoStore }}, 0, n)
+    {{- end }}
+
+	var r rec
+	for c.row = 0; c.row < n; c.row++ {
+		r = rec{}
+		if !c.getrec(&r) {
+			continue
 		}
+        {{- range .Columns }}
+            seg.{{ .Name }} = append(seg.{{ .Name }}, r.{{ .Name }})
+        {{- end }}
 	}
 
-	return nil
+	return seg
 }
 
 // writeconfig writes the configuration information for the gocols dataset.  This
@@ -206,9 +276,10 @@ func writeconfig() {
         NumBuckets uint32
 		Compression string
 		CodesDir string
+		Hash string
     }
 
-    c := Config{NumBuckets: conf.NumBuckets, Compression: "snappy", CodesDir: conf.CodesDir}
+    c := Config{NumBuckets: conf.NumBuckets, Compression: "snappy", CodesDir: conf.CodesDir, Hash: conf.Hash}
 
     fid, err := os.Create(path.Join(conf.TargetDir, "conf.json"))
 	if err != nil {
@@ -222,16 +293,105 @@ func writeconfig() {
     }
 }
 
+// checkappend confirms that the existing dataset in TargetDir can
+// receive the data being appended.
+func checkappend() {
+
+	type Config struct {
+		NumBuckets uint32
+		Hash string
+	}
+
+	fid, err := os.Open(path.Join(conf.TargetDir, "conf.json"))
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	var c Config
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(&c)
+	if err != nil {
+		panic(err)
+	}
+
+	if c.NumBuckets != conf.NumBuckets {
+		msg := fmt.Sprintf("Existing dataset has %d buckets, configuration has %d buckets\n",
+			c.NumBuckets, conf.NumBuckets)
+		panic(msg)
+	}
+
+	// Datasets written before the hash was configurable use adler32.
+	if c.Hash == "" {
+		c.Hash = "adler32"
+	}
+	if c.Hash != conf.Hash {
+		msg := fmt.Sprintf("Existing dataset uses hash %s, configuration has hash %s\n",
+			c.Hash, conf.Hash)
+		panic(msg)
+	}
+
+	newtypes := make(map[string]string)
+	err = json.Unmarshal([]byte(dtypes), &newtypes)
+	if err != nil {
+		panic(err)
+	}
+
+	for k := 0; k < int(conf.NumBuckets); k++ {
+		oldtypes := config.ReadDtypes(k, conf)
+		err = config.CheckAppendDtypes(oldtypes, newtypes)
+		if err != nil {
+			print("In bucket ", k, "\n\n")
+			panic(err)
+		}
+	}
+}
+
+// writereport saves the conversion reports, and logs a summary of
+// the conversion problems.
+func writereport() {
+
+	config.WriteReport(conf, reports)
+
+	for _, r := range reports {
+		logger.Printf("%s: read %d rows, %d skipped for missing key, %d filtered",
+			r.File, r.RowsRead, r.RowsDroppedKey, r.RowsFiltered)
+		if len(r.AbsentVars) > 0 {
+			logger.Printf("%s: variables not found: %v", r.File, r.AbsentVars)
+		}
+		for vn, vr := range r.Vars {
+			if vr.ParseErrors > 0 || vr.OutOfRange > 0 || vr.Truncated > 0 {
+				logger.Printf("%s: variable %s had %d parse errors, %d out of range values and %d truncated values, e.g. %v",
+					r.File, vn, vr.ParseErrors, vr.OutOfRange, vr.Truncated, vr.Samples)
+			}
+		}
+	}
+}
+
+// bucketdir returns the directory where the data for the given
+// bucket are written.  When appending, this is the staging area.
+func bucketdir(bucket int) string {
+	if conf.Append {
+		return config.StagePath(bucket, conf)
+	}
+	return config.BucketPath(bucket, conf)
+}
+
 func setup() {
 
-	rslt_chan = make(chan *rec)
+	wchans = make([]chan *batch, conf.Writers)
+	for w := range wchans {
+		wchans[w] = make(chan *batch, conf.WriterQueue)
+	}
 	sem = make(chan bool, conf.Concurrency)
+	reports = make(map[string]*config.FileReport)
 
 	buckets = make([]*Bucket, conf.NumBuckets)
 	for i, _ := range buckets {
 		buckets[i] = new(Bucket)
 		buckets[i].BucketNum = uint32(i)
 		buckets[i].Conf = conf
+		buckets[i].Crcs = make(map[string]uint32)
+		buckets[i].Stats = make(map[string]*config.ColumnStats)
 	}
 
 	err := os.MkdirAll(conf.TargetDir, 0755)
@@ -239,19 +399,26 @@ func setup() {
 		panic(err)
 	}
 
-	writeconfig()
+	// When appending, the existing buckets are left in place and
+	// the new data are written to a staging area.
+	root := "Buckets"
+	if conf.Append {
+		logger.Printf("Appending to existing dataset in %s", conf.TargetDir)
+		checkappend()
+		root = "Append"
+	} else {
+		writeconfig()
+	}
 
-	fn := path.Join(conf.TargetDir, "Buckets")
+	fn := path.Join(conf.TargetDir, root)
 	err = os.RemoveAll(fn)
 	if err != nil {
 		panic(err)
 	}
 
-	pa := path.Join(conf.TargetDir, "Buckets")
-	os.MkdirAll(pa, 0755)
+	os.MkdirAll(fn, 0755)
 	for k := 0; k < int(conf.NumBuckets); k++ {
-		bns := fmt.Sprintf("%04d", k)
-		dn := path.Join(conf.TargetDir, "Buckets", bns)
+		dn := bucketdir(k)
 		err = os.MkdirAll(dn, 0755)
 		if err != nil {
 			panic(err)
@@ -269,15 +436,124 @@ func setup() {
 	}
 }
 
+// startwriters starts the goroutines that write the buckets.
+func startwriters() {
+	for w := 0; w < conf.Writers; w++ {
+		wwg.Add(1)
+		go writer(w)
+	}
+}
+
+// finish waits for all the chunks to be processed, then writes the
+// remaining data in the buckets to disk.
+func finish() {
+
+	wg.Wait()
+	for _, c := range wchans {
+		close(c)
+	}
+	wwg.Wait()
+
+	for k := 0; k < int(conf.NumBuckets); k++ {
+		buckets[k].Flush()
+		config.SetChecksums(bucketdir(k), buckets[k].Crcs)
+		config.SetStats(bucketdir(k), buckets[k].Stats)
+	}
+}
+
+// hasdataset returns true if TargetDir contains buckets or a
+// manifest, so that bench does not replace an existing dataset.
+func hasdataset() bool {
+	for _, fn := range []string{"Buckets", "manifest.json"} {
+		if _, err := os.Stat(path.Join(conf.TargetDir, fn)); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// bench converts nrows rows of synthetic data resembling the SAS
+// files, and reports the conversion rate.  The data are written to
+// TargetDir as in a regular run, but the manifest and report are not
+// written.  TargetDir must not already contain a dataset.
+func bench(nrows int) {
+
+	start := time.Now()
+
+	setup()
+	startwriters()
+
+	chunksize := int(conf.SASChunkSize)
+	if chunksize == 0 {
+		chunksize = 100000
+	}
+
+	// A fixed seed so that runs are comparable
+	rng := rand.New(rand.NewSource(1))
+
+	// sendrecs merges the chunk reports into this report
+	reports["synthetic"] = config.NewFileReport("synthetic")
+
+	for done := 0; done < nrows; done += chunksize {
+		n := chunksize
+		if nrows-done < n {
+			n = nrows - done
+		}
+		c := synthchunk(rng, n)
+		c.file = "synthetic"
+		c.rpt = config.NewFileReport(c.file)
+		wg.Add(1)
+		sem <- true
+		go sendrecs(c)
+	}
+
+	finish()
+
+	el := time.Since(start)
+	msg := fmt.Sprintf("Converted %d rows in %v, %.0f rows per second\n",
+		nrows, el, float64(nrows)/el.Seconds())
+	logger.Print(msg)
+	os.Stdout.WriteString(msg)
+}
+
+// synthchunk returns a chunk containing n rows of random data, with
+// about 1% of the values missing.
+func synthchunk(rng *rand.Rand, n int) *chunk {
+
+	c := new(chunk)
+    {{- range .NameType }}
+        c.{{ .Name }} = make([]{{ .SASType }}, n)
+        c.{{ .Name }}m = make([]bool, n)
+    {{- end }}
+
+	for i := 0; i < n; i++ {
+        {{- range .NameType }}
+            {{- if .KeyVar }}
+                c.{{ .Name }}[i] = float64(rng.Int63n(1000000))
+            {{- else }}
+                if rng.Intn(100) == 0 {
+                    c.{{ .Name }}m[i] = true
+                    {{- if eq .SASType "float64" }}
+                        c.{{ .Name }}[i] = math.NaN()
+                    {{- end }}
+                } else {
+                    {{- template "synth" . }}
+                }
+            {{- end }}
+        {{- end }}
+	}
+
+	return c
+}
+
 func Run(cnf *config.Config, lgr *log.Logger) {
 
 	logger = lgr
 	conf = cnf
+	start := time.Now()
 
 	setup()
-
-	hwg.Add(1)
-	go harvest()
+	startwriters()
 
 	for _, fn := range conf.SASFiles {
 		fn = path.Join(conf.SourceDir, fn)
@@ -285,32 +561,64 @@ func Run(cnf *config.Config, lgr *log.Logger) {
 		go dofile(fn)
 	}
 
-	wg.Wait()
-	close(rslt_chan)
-	hwg.Wait()
+	finish()
+	writereport()
 
-	for k := 0; k < int(conf.NumBuckets); k++ {
-		buckets[k].Flush()
-	}
+	// A new dataset gets a new manifest.  Appended data are not in
+	// the buckets until they are merged, but the sources are
+	// recorded now.
+	config.UpdateManifest(conf, "sastocols", start, func(m *config.Manifest) {
+		if !conf.Append {
+			*m = config.Manifest{}
+		}
+		for _, si := range sources {
+			if r, ok := reports[si.File]; ok {
+				si.ParseErrors, si.OutOfRange, si.Truncated = r.Totals()
+			}
+		}
+		m.Sources = append(m.Sources, sources...)
+	})
 
 	logger.Printf("All done")
 }
 
-// rec is a row that will be added to a Bucket.
+// rec holds the values of one row while it is converted.
 type rec struct {
-    {{ range .NameType }}
-        {{ .Name }} {{ .GoType }}
+    {{ range .Columns }}
+        {{ .Name }} {{ .GoStore }}
     {{- end }}
 }
 
+// segment contains the converted values of a set of rows, by column.
+type segment struct {
+    {{ range .Columns }}
+        {{ .Name }} []{{ .GoStore }}
+    {{- end }}
+}
+
+// permute returns a segment with the rows in the order given by
+// perm.
+func (seg *segment) permute(perm []int) *segment {
+
+	ps := new(segment)
+    {{- range .Columns }}
+        ps.{{ .Name }} = make([]{{ .GoStore }}, len(perm))
+        for i, j := range perm {
+            ps.{{ .Name }}[i] = seg.{{ .Name }}[j]
+        }
+    {{- end }}
+
+	return ps
+}
+
 // Bucket is a memory-backed container for columnized data.  It
 // contains data exactly as it will be written to disk.
 type Bucket struct {
     BaseBucket
 
     code []uint16
-    {{- range .NameType }}
-        {{ .Name }} []{{ .GoType }}
+    {{- range .Columns }}
+        {{ .Name }} []{{ .GoStore }}
     {{- end }}
 }
 
@@ -320,6 +628,12 @@ type chunk struct {
     row int
     col int
 
+    // The SAS file that the chunk was read from
+    file string
+
+    // Conversion problems found in this chunk
+    rpt *config.FileReport
+
     {{- range .NameType }}
         {{ .Name }} []{{ .SASType }}
         {{ .Name }}m []bool
@@ -327,20 +641,66 @@ type chunk struct {
 }
 
 
-// Add appends a rec to the end of the Bucket.
-func (bucket *Bucket) Add(r *rec) {
+// Add appends rows lo to hi-1 of a segment to the end of the Bucket.
+func (bucket *Bucket) Add(seg *segment, lo, hi int) {
+
+	// The in-memory size of the rows
+	n := int64({{ .RecSize }} * (hi - lo))
+    {{- range .Columns }}
+        {{- if eq .GoStore "string" }}
+            for _, x := range seg.{{ .Name }}[lo:hi] {
+                n += int64(len(x) + 16)
+            }
+        {{- end }}
+    {{- end }}
 
 	bucket.Mut.Lock()
 
-    {{ range .NameType }}
-        bucket.{{ .Name }} = append(bucket.{{ .Name }}, r.{{  .Name }})
+    {{ range .Columns }}
+        bucket.{{ .Name }} = append(bucket.{{ .Name }}, seg.{{ .Name }}[lo:hi]...)
     {{- end }}
 
+	atomic.AddInt64(&bucket.Bytes, n)
+	total := atomic.AddInt64(&buffered, n)
+
+	// The length is checked while the bucket is locked, since
+	// another writer may be flushing it.
+	full := conf.BufMaxRecs > 0 && uint64(len(bucket.{{ .KeyVar }})) > conf.BufMaxRecs
+
 	bucket.Mut.Unlock()
 
-	if uint64(len(bucket.{{ .KeyVar }})) > conf.BufMaxRecs {
+	if full {
 		bucket.Flush()
 	}
+
+	if conf.MemoryBudget > 0 && total > int64(conf.MemoryBudget) {
+		reduce()
+	}
+}
+
+// reduce flushes the buckets with the most data until the buffered
+// data use no more than 3/4 of the memory budget.  Other writers
+// that exceed the budget wait until this is done.
+func reduce() {
+
+	bmut.Lock()
+	defer bmut.Unlock()
+
+	target := int64(conf.MemoryBudget) / 4 * 3
+	for atomic.LoadInt64(&buffered) > target {
+		var big *Bucket
+		var nb int64
+		for _, b := range buckets {
+			if x := atomic.LoadInt64(&b.Bytes); x > nb {
+				big = b
+				nb = x
+			}
+		}
+		if big == nil {
+			break
+		}
+		big.Flush()
+	}
 }
 
 // Flush writes all the data from the Bucket to disk.
@@ -350,14 +710,39 @@ func (bucket *Bucket) Flush() {
 
 	bucket.Mut.Lock()
 
-        {{ range .NameType }}
-	        bucket.flush{{ .GoType }}("{{ .Name }}", bucket.{{ .Name }})
+        {{ range .Columns }}
+	        bucket.flush{{ .GoStore }}("{{ .Name }}", bucket.{{ .Name }})
 	        bucket.{{ .Name }} = bucket.{{ .Name }}[0:0]
         {{- end }}
 
+	n := atomic.SwapInt64(&bucket.Bytes, 0)
+	atomic.AddInt64(&buffered, -n)
+
 	bucket.Mut.Unlock()
 }
 
+// summarize adds the values in a chunk to the chunk's report.
+func (c *chunk) summarize() {
+
+	c.rpt.RowsRead = int64(len(c.{{ .KeyVar }}))
+
+    {{- range .NameType }}
+        {{- if not .Must }}
+            if c.{{ .Name }} == nil {
+                c.rpt.Absent("{{ .Name }}")
+            } else {
+        {{- end }}
+        {{- if eq .SASType "string" }}
+            c.rpt.AddStrings("{{ .Name }}", c.{{ .Name }}, c.{{ .Name }}m)
+        {{- else }}
+            c.rpt.AddFloats("{{ .Name }}", c.{{ .Name }}, c.{{ .Name }}m)
+        {{- end }}
+        {{- if not .Must }}
+            }
+        {{- end }}
+    {{- end }}
+}
+
 // getcols fills a chunk with data from a SAS file.
 func (c *chunk) getcols(data []*datareader.Series, cm map[string]int) error {
 
@@ -382,47 +767,105 @@ func (c *chunk) getcols(data []*datareader.Series, cm map[string]int) error {
     return nil
 }
 
-func (c *chunk) trynextrec() (*rec, bool) {
-
-	if c.row >= len(c.{{ .KeyVar }}) {
-		return nil, false
-	}
-
-	r := new(rec)
+// getrec converts the current row of the chunk into r.  Returns
+// false if the row is skipped.
+func (c *chunk) getrec(r *rec) bool {
 
 	i := c.row
 
     // Check if key variable is missing
 	if c.{{ .KeyVar }}m[i] {
-	        c.row++
-	        return nil, true
+	        c.rpt.RowsDroppedKey++
+	        return false
     }
 
+    // Missing dates and datetimes are stored as config.MissingDate
+    // and config.MissingDatetime, the values that are present
+    // replace these below.
+    {{- range .Columns }}
+        {{- if eq .GoType "date" }}
+            r.{{ .Name }} = config.MissingDate
+        {{- else if eq .GoType "datetime" }}
+            r.{{ .Name }} = config.MissingDatetime
+        {{- end }}
+    {{- end }}
+
     {{ range .NameType }}
         {{ if not .Must }}
             if c.{{ .Name }} != nil {
         {{ end }}
-        {{ if and (eq .SASType "string") (ne .GoType "string") }}
+        {{ if and (eq .SASType "string") (eq .GoType "date") }}
+            // Convert formatted string to date
+            if s := strings.TrimSpace(c.{{ .Name }}[i]); len(s) > 0 {
+                t, err := time.Parse("{{ .DateFormat }}", s)
+                if err == nil {
+                    r.{{ .Name }} = config.TimeToDate(t)
+                } else {
+                    c.rpt.ParseError("{{ .Name }}", s, err)
+                }
+            }
+        {{ else if and (eq .SASType "string") (eq .GoType "datetime") }}
+            // Convert formatted string to datetime
+            if s := strings.TrimSpace(c.{{ .Name }}[i]); len(s) > 0 {
+                t, err := time.Parse("{{ .DateFormat }}", s)
+                if err == nil {
+                    r.{{ .Name }} = config.TimeToDatetime(t)
+                } else {
+                    c.rpt.ParseError("{{ .Name }}", s, err)
+                }
+            }
+        {{ else if and (eq .SASType "string") (ne .GoType "string") }}
             // Convert string to number
-            if len(c.{{ .Name }}[i]) > 0 {
-                x, err := strconv.Atoi(c.{{ .Name }}[i])
-		        if err == nil {
-                    r.{{ .Name }} = {{ .GoType }}(x)
-		        }
+            if s := strings.TrimSpace(c.{{ .Name }}[i]); len(s) > 0 {
+                x, err := parse{{ .GoStore }}(s)
+                if err == nil {
+                    r.{{ .Name }} = x
+                } else {
+                    c.rpt.ParseError("{{ .Name }}", s, err)
+                    if errors.Is(err, strconv.ErrRange) {
+                        {{- if eq .Overflow "error" }}
+                            v := s
+                        {{- end }}
+                        {{- template "overflow" . }}
+                    }
+                }
             }
         {{ else if eq .GoType "string" }}
             r.{{ .Name }} = strings.TrimSpace(c.{{ .Name }}[i])
+        {{ else if hasPrefix .GoStore "float" }}
+            {{- template "convert" . }}
         {{ else }}
-            r.{{ .Name }} = {{ .GoType }}(c.{{ .Name }}[i])
+            // Missing values are stored as zero, or as the
+            // missing date or datetime
+            if !c.{{ .Name }}m[i] {
+                {{- template "convert" . }}
+            }
         {{ end }}
         {{ if not .Must }}
             }
         {{ end }}
     {{- end }}
 
-    c.row++
+    {{ if .Derived }}
+        // Compute the derived variables
+        {{- range .Derived }}
+            {{- if eq .GoType "string" }}
+                r.{{ .Name }} = {{ .Expr }}
+            {{- else }}
+                {{- template "convert" . }}
+            {{- end }}
+        {{- end }}
+    {{ end }}
+
+    {{ if .Filter }}
+        // Skip rows that do not satisfy the filter
+        if !({{ .Filter }}) {
+            c.rpt.RowsFiltered++
+            return false
+        }
+    {{ end }}
 
-	return r, true
+	return true
 }
 
 type BaseBucket struct {
@@ -435,12 +878,47 @@ type BaseBucket struct {
 	Mut sync.Mutex
 
 	Conf *config.Config
+
+	// The approximate number of bytes of data held in the
+	// bucket's buffers, accessed atomically.
+	Bytes int64
+
+	// Checksums of the data written to each column file, keyed by
+	// file name.
+	Crcs map[string]uint32
+
+	// Statistics of the data written to each column, keyed by
+	// variable name.
+	Stats map[string]*config.ColumnStats
+
+	// Space for encoding the data being written
+	buf []byte
+}
+
+// getbuf returns a slice of the bucket's encoding space with length
+// n.
+func (bucket *BaseBucket) getbuf(n int) []byte {
+	if cap(bucket.buf) < n {
+		bucket.buf = make([]byte, n)
+	}
+	return bucket.buf[0:n]
+}
+
+// stats returns the statistics for a column, creating them if
+// necessary.
+func (bucket *BaseBucket) stats(varname string) *config.ColumnStats {
+	cs, ok := bucket.Stats[varname]
+	if !ok {
+		cs = new(config.ColumnStats)
+		bucket.Stats[varname] = cs
+	}
+	return cs
 }
 
 // openfile opens a file for appending data in the bucket's directory.
 func (bucket *BaseBucket) openfile(varname string) (io.Closer, io.WriteCloser) {
 
-	bp := config.BucketPath(int(bucket.BucketNum), bucket.Conf)
+	bp := bucketdir(int(bucket.BucketNum))
 	fn := path.Join(bp, varname+".bin.sz")
 	fid, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
@@ -455,20 +933,25 @@ func (bucket *BaseBucket) openfile(varname string) (io.Closer, io.WriteCloser) {
 func (bucket *BaseBucket) flushstring(varname string, vec []string) {
 
 	toclose, wtr := bucket.openfile(varname)
+	fn := varname + ".bin.sz"
+	cw := &config.ChecksumWriter{W: wtr, Sum: bucket.Crcs[fn]}
+	cs := bucket.stats(varname)
 
-    nl := []byte("\n")
+	buf := bucket.buf[0:0]
 	for _, x := range vec {
-		_, err := wtr.Write([]byte(x))
-		if err != nil {
-			panic(err)
-		}
-		_, err = wtr.Write(nl)
-		if err != nil {
-			panic(err)
-		}
+		cs.AddString(x)
+		buf = append(buf, x...)
+		buf = append(buf, '\n')
+	}
+	bucket.buf = buf
+
+	_, err := cw.Write(buf)
+	if err != nil {
+		panic(err)
 	}
+	bucket.Crcs[fn] = cw.Sum
 
-	err := wtr.Close()
+	err = wtr.Close()
 	if err != nil {
  	    panic(err)
     }
@@ -479,18 +962,104 @@ func (bucket *BaseBucket) flushstring(varname string, vec []string) {
 }
 
 {{- range .Rtypes }}
+    // parse{{ . }} converts a string to a {{ . }} value, returning an
+    // error if the string is not a valid number or is out of range.
+    func parse{{ . }}(s string) ({{ . }}, error) {
+        {{- if hasPrefix . "uint" }}
+            x, err := config.ParseUint(s, {{ bits . }})
+        {{- else if hasPrefix . "int" }}
+            x, err := config.ParseInt(s, {{ bits . }})
+        {{- else }}
+            x, err := strconv.ParseFloat(s, {{ bits . }})
+        {{- end }}
+        {{- if hasPrefix . "float" }}
+            // Overflow gives an infinite value, use the largest finite
+            // value instead.
+            if math.IsInf(x, 0) {
+                x = math.Copysign({{ maxval . }}, x)
+            }
+        {{- end }}
+        return {{ . }}(x), err
+    }
+
+    {{- if ne . "float64" }}
+        // cvt{{ . }} converts a float64 to a {{ . }} value.  If the
+        // value is out of range, the nearest value in range is
+        // returned.  The second return value reports whether the value
+        // was converted exactly, truncated, out of range, or missing
+        // (NaN, for integer types).
+        func cvt{{ . }}(x float64) ({{ . }}, int) {
+            {{- if hasPrefix . "float" }}
+                if x < -{{ maxval . }} {
+                    return -{{ maxval . }}, convOutOfRange
+                }
+                if x > {{ maxval . }} {
+                    return {{ maxval . }}, convOutOfRange
+                }
+                return {{ . }}(x), convOK
+            {{- else }}
+                if math.IsNaN(x) {
+                    return 0, convMissing
+                }
+                if x < {{ minval . }} {
+                    return {{ minval . }}, convOutOfRange
+                }
+                if x >= {{ maxval . }} + 1 {
+                    return {{ maxval . }}, convOutOfRange
+                }
+                if x != math.Trunc(x) {
+                    return {{ . }}(x), convTruncated
+                }
+                return {{ . }}(x), convOK
+            {{- end }}
+        }
+    {{- end }}
+
     func (bucket *BaseBucket) flush{{ . }}(varname string, vec []{{ . }}) {
 
 	    toclose, wtr := bucket.openfile(varname)
+	    fn := varname + ".bin.sz"
+	    cw := &config.ChecksumWriter{W: wtr, Sum: bucket.Crcs[fn]}
+	    cs := bucket.stats(varname)
+
+	    {{- if or (eq . "int32") (eq . "int64") }}
+	        // Missing dates and datetimes are not included in the
+	        // range of the values.
+	        istime := timecols[varname]
+	    {{- end }}
+
+	    // Encode the values as little endian bytes
+	    buf := bucket.getbuf({{ size . }} * len(vec))
+    	for i, x := range vec {
+	    	{{- if eq . "int32" }}
+	    	    if istime {
+	    	        cs.AddDate(x)
+	    	    } else {
+	    	        cs.Add(float64(x))
+	    	    }
+	    	{{- else if eq . "int64" }}
+	    	    if istime {
+	    	        cs.AddDatetime(x)
+	    	    } else {
+	    	        cs.Add(float64(x))
+	    	    }
+	    	{{- else }}
+	    	    cs.Add(float64(x))
+	    	{{- end }}
+	    	{{- if eq . "uint8" }}
+	    	    buf[i] = x
+	    	{{- else }}
+	    	    binary.LittleEndian.PutUint{{ bits . }}(buf[{{ size . }}*i:], {{ lebits . }}(x))
+	    	{{- end }}
+	    }
 
-    	for _, x := range vec {
-	    	err := binary.Write(wtr, binary.LittleEndian, x)
-		    if err != nil {
-			    panic(err)
-		    }
+	    _, err := cw.Write(buf)
+	    if err != nil {
+		    panic(err)
 	    }
+	    bucket.Crcs[fn] = cw.Sum
 
-	    err := wtr.Close()
+	    err = wtr.Close()
 	    if err != nil {
             panic(err)
         }
@@ -501,16 +1070,107 @@ func (bucket *BaseBucket) flushstring(varname string, vec []string) {
     }
 {{- end }}
 
+// Results of converting a float64 value to a column type.  Missing
+// (NaN) values are converted exactly to floating point types, and
+// give convMissing for integer types, since converting NaN to an
+// integer does not give a defined value.
+const (
+	convOK = iota
+	convTruncated
+	convOutOfRange
+	convMissing
+)
+
+// timecols contains the names of the date and datetime columns.
+var timecols = map[string]bool{
+    {{- range .Columns }}
+        {{- if or (eq .GoType "date") (eq .GoType "datetime") }}
+            "{{ .Name }}": true,
+        {{- end }}
+    {{- end }}
+}
+
+// sasepoch is the origin of SAS dates.
+var sasepoch = time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fn_sasdate converts a SAS date (days since 1960-01-01) to days
+// since 1970-01-01.
+func fn_sasdate(x float64) float64 {
+	return x - 3653
+}
+
+// fn_year returns the calendar year of a SAS date, or NaN if the date
+// is missing.
+func fn_year(x float64) float64 {
+	if math.IsNaN(x) {
+		return x
+	}
+	return float64(sasepoch.AddDate(0, 0, int(x)).Year())
+}
+
+// fn_month returns the calendar month (1-12) of a SAS date, or NaN if
+// the date is missing.
+func fn_month(x float64) float64 {
+	if math.IsNaN(x) {
+		return x
+	}
+	return float64(sasepoch.AddDate(0, 0, int(x)).Month())
+}
+
+// fn_age returns the age in years on a SAS date, given a birth year.
+func fn_age(byear, x float64) float64 {
+	return fn_year(x) - byear
+}
+
+// fn_str formats a value as a string.  Numeric values are converted
+// to float64 in expressions, so they are formatted without exponents.
+func fn_str(x interface{}) string {
+	if f, ok := x.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(x)
+}
+
+// fn_concat formats its arguments as strings and joins them.
+func fn_concat(args ...interface{}) string {
+	var s []string
+	for _, x := range args {
+		s = append(s, fn_str(x))
+	}
+	return strings.Join(s, "")
+}
+
 func main() {
 
+	if len(os.Args) == 4 && os.Args[1] == "bench" {
+		conf = config.ReadConfig(os.Args[2])
+		nrows, err := strconv.Atoi(os.Args[3])
+		if err != nil {
+			panic(err)
+		}
+		config.MustLock(conf, "sastocols bench")
+		defer config.Unlock(conf)
+		if hasdataset() {
+			msg := fmt.Sprintf("sastocols: %s already contains a dataset, which bench would replace.\nUse a configuration with a new TargetDir for benchmarking.\n", conf.TargetDir)
+			os.Stderr.WriteString(msg)
+			config.Unlock(conf)
+			os.Exit(1)
+		}
+		setupLogger()
+		bench(nrows)
+		return
+	}
+
 	if len(os.Args) != 2 {
 		os.Stderr.WriteString("sastocols: Wrong number of arguments\n\n")
-		msg := fmt.Sprintf("Usage: %s config.toml\n\n", os.Args[0])
+		msg := fmt.Sprintf("Usage: %s config.toml\n       %s bench config.toml nrows\n\n", os.Args[0], os.Args[0])
 		os.Stderr.WriteString(msg)
 		os.Exit(1)
 	}
 
 	conf = config.ReadConfig(os.Args[1])
+	config.MustLock(conf, "sastocols")
+	defer config.Unlock(conf)
 	setupLogger()
 	logger.Printf("Read config from %s", os.Args[1])
 
@@ -518,6 +1178,81 @@ func main() {
 
 	logger.Printf("Finished, exiting")
 }
+
+{{/* synth sets row i of a chunk to a random value */}}
+{{- define "synth" }}
+    {{- if eq .SASType "string" }}
+        {{- if eq .GoType "string" }}
+            c.{{ .Name }}[i] = fmt.Sprintf("C%03d", rng.Intn(500))
+        {{- else if eq .GoType "date" }}
+            c.{{ .Name }}[i] = time.Unix(int64(14600+rng.Intn(3650))*86400, 0).UTC().Format("{{ .DateFormat }}")
+        {{- else if eq .GoType "datetime" }}
+            c.{{ .Name }}[i] = time.Unix(int64(14600+rng.Intn(3650))*86400+int64(rng.Intn(86400)), 0).UTC().Format("{{ .DateFormat }}")
+        {{- else }}
+            c.{{ .Name }}[i] = strconv.Itoa(rng.Intn(100))
+        {{- end }}
+    {{- else if eq .GoType "date" }}
+        c.{{ .Name }}[i] = float64(18250 + rng.Intn(3650))
+    {{- else if eq .GoType "datetime" }}
+        c.{{ .Name }}[i] = float64(18250+rng.Intn(3650))*86400 + float64(rng.Intn(86400))
+    {{- else if hasPrefix .GoType "float" }}
+        c.{{ .Name }}[i] = 1000 * rng.Float64()
+    {{- else }}
+        c.{{ .Name }}[i] = float64(rng.Intn(100))
+    {{- end }}
+{{- end }}
+
+{{/* convert stores a float64 value in a column, checking its range */}}
+{{- define "convert" }}
+    {{- if eq .GoStore "float64" }}
+        r.{{ .Name }} = {{ .CastSrc }}
+    {{- else }}
+        {
+            v := {{ .CastSrc }}
+            x, st := cvt{{ .GoStore }}(v)
+            {{- if eq .GoType "date" }}
+                // The smallest value is the missing date, so it is
+                // out of range
+                if x == config.MissingDate && st != convMissing {
+                    x, st = config.MissingDate+1, convOutOfRange
+                }
+            {{- else if eq .GoType "datetime" }}
+                // The smallest value is the missing datetime, so it
+                // is out of range
+                if x == config.MissingDatetime && st != convMissing {
+                    x, st = config.MissingDatetime+1, convOutOfRange
+                }
+            {{- end }}
+            switch st {
+            case convTruncated:
+                c.rpt.RecordTruncated("{{ .Name }}", v)
+                r.{{ .Name }} = x
+            case convOutOfRange:
+                c.rpt.RecordOutOfRange("{{ .Name }}", v)
+                {{- template "overflow" . }}
+            case convMissing:
+                // Missing values are stored as zero, or as the
+                // missing date or datetime
+            default:
+                r.{{ .Name }} = x
+            }
+        }
+    {{- end }}
+{{- end }}
+
+{{/* overflow applies the overflow policy to an out of range value v,
+     where x is the nearest value in range */}}
+{{- define "overflow" }}
+    {{- if eq .Overflow "error" }}
+        panic(fmt.Sprintf("%s: value %v of {{ .Name }} is out of range for {{ .GoType }}\n", c.file, v))
+    {{- else if eq .Overflow "missing" }}
+        {{- if hasPrefix .GoStore "float" }}
+            r.{{ .Name }} = {{ .GoStore }}(math.NaN())
+        {{- end }}
+    {{- else }}
+        r.{{ .Name }} = x
+    {{- end }}
+{{- end }}
 `
 
 // tvals contains values that are to be inserted into the code
@@ -526,7 +1261,38 @@ type tvals struct {
 	Rtypes   []string
 	Dtypes   string
 	NameType []*config.VarDesc
+	Derived  []*config.VarDesc
+	Columns  []*config.VarDesc
 	KeyVar   string
+	Filter   string
+
+	// The size in bytes of the fixed width columns of a record
+	RecSize int
+}
+
+// limits contains the smallest and largest values of the numeric
+// column types, as Go constant expressions.
+var limits = map[string][2]string{
+	"uint8":   {"0", "math.MaxUint8"},
+	"uint16":  {"0", "math.MaxUint16"},
+	"uint32":  {"0", "math.MaxUint32"},
+	"uint64":  {"0", "math.MaxUint64"},
+	"int32":   {"math.MinInt32", "math.MaxInt32"},
+	"int64":   {"math.MinInt64", "math.MaxInt64"},
+	"float32": {"-math.MaxFloat32", "math.MaxFloat32"},
+	"float64": {"-math.MaxFloat64", "math.MaxFloat64"},
+}
+
+// lebits contains the functions that give the bits of the numeric
+// column types as unsigned integers.
+var lebits = map[string]string{
+	"uint16":  "uint16",
+	"uint32":  "uint32",
+	"uint64":  "uint64",
+	"int32":   "uint32",
+	"int64":   "uint64",
+	"float32": "math.Float32bits",
+	"float64": "math.Float64bits",
 }
 
 // getdtypes returns a json encoded map describing the dtypes, based
@@ -555,19 +1321,75 @@ func main() {
 		panic("wrong number of arguments")
 	}
 
-	vdesca := config.GetVarDefs(os.Args[1])
+	vdefs := config.ReadVarDefs(os.Args[1])
+	vdesca := vdefs.Variable
+
+	funcs := template.FuncMap{
+		"hasPrefix": strings.HasPrefix,
+		"bits":      func(t string) int { return 8 * config.DTsize[t] },
+		"size":      func(t string) int { return config.DTsize[t] },
+		"lebits":    func(t string) string { return lebits[t] },
+		"minval":    func(t string) string { return limits[t][0] },
+		"maxval":    func(t string) string { return limits[t][1] },
+	}
 
-	tmpl, err := template.New("script").Parse(script)
+	tmpl, err := template.New("script").Funcs(funcs).Parse(script)
 	if err != nil {
 		panic(err)
 	}
 
-	rtypes := []string{"uint8", "uint16", "uint32", "uint64", "float32", "float64"}
+	rtypes := []string{"uint8", "uint16", "uint32", "uint64", "int32", "int64", "float32", "float64"}
+
+	// The columns written to the buckets
+	var columns []*config.VarDesc
+	columns = append(columns, vdesca...)
+	columns = append(columns, vdefs.Derived...)
 
 	tval := &tvals{
 		Rtypes:   rtypes,
 		NameType: vdesca,
-		Dtypes:   getdtypes(vdesca),
+		Derived:  vdefs.Derived,
+		Columns:  columns,
+		Dtypes:   getdtypes(columns),
+	}
+
+	for _, v := range columns {
+		tval.RecSize += config.DTsize[v.GoStore]
+	}
+
+	// Translate the derived variable expressions into Go code
+	// operating on a rec.  Each derived variable can use the
+	// variables that are defined before it.
+	for j, v := range vdefs.Derived {
+		v.Expr, err = config.TranslateExpr(v.Expr, "r", columns[0:len(vdesca)+j])
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Translate the filter into Go code operating on a rec
+	if vdefs.Filter != "" {
+		tval.Filter, err = config.TranslateExpr(vdefs.Filter, "r", columns)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// The float64 expressions that are converted to the column
+	// types.  Dates and datetimes are stored relative to
+	// 1970-01-01 rather than the SAS epoch.
+	for _, v := range columns {
+		src := "(" + v.Expr + ")"
+		if v.Expr == "" {
+			src = "c." + v.Name + "[i]"
+		}
+		switch v.GoType {
+		case "date":
+			src += " - config.SASDateOffset"
+		case "datetime":
+			src += " - config.SASDatetimeOffset"
+		}
+		v.CastSrc = src
 	}
 
 	// Set the key variable
@@ -0,0 +1,264 @@
+package sortbuckets
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/kshedden/gosascols/config"
+)
+
+// mergeorder returns the interleaving of the rows of two sorted
+// buckets.  The k'th row of the merged bucket is taken from the
+// second bucket if from2[k] is true, otherwise it is taken from the
+// first bucket.  Ties are taken from the first bucket.  The number
+// of rows in the second bucket is also returned.
+func mergeorder(dir1, dir2 string) ([]bool, int) {
+
+	d1 := getkeys(dir1)
+	d2 := getkeys(dir2)
+
+	from2 := make([]bool, 0, len(d1)+len(d2))
+	var i, j int
+	for i < len(d1) || j < len(d2) {
+		if j < len(d2) && (i == len(d1) || d2[j].less(d1[i])) {
+			from2 = append(from2, true)
+			j++
+		} else {
+			from2 = append(from2, false)
+			i++
+		}
+	}
+
+	return from2, len(d2)
+}
+
+// Merge two slices containing fixed width values of width w, using
+// the interleaving in from2.
+func mergebytes(x, y []byte, from2 []bool, w int) []byte {
+
+	z := make([]byte, len(x)+len(y))
+	if len(from2)*w != len(z) {
+		panic("mergebytes: length error")
+	}
+
+	var i, j int
+	for k, f := range from2 {
+		if f {
+			copy(z[w*k:w*(k+1)], y[w*j:w*(j+1)])
+			j++
+		} else {
+			copy(z[w*k:w*(k+1)], x[w*i:w*(i+1)])
+			i++
+		}
+	}
+
+	return z
+}
+
+// Merge two slices of uint64, using the interleaving in from2.
+func mergeuint64(x, y []uint64, from2 []bool) []uint64 {
+
+	if len(from2) != len(x)+len(y) {
+		panic("mergeuint64: length error")
+	}
+
+	z := make([]uint64, len(from2))
+	var i, j int
+	for k, f := range from2 {
+		if f {
+			z[k] = y[j]
+			j++
+		} else {
+			z[k] = x[i]
+			i++
+		}
+	}
+
+	return z
+}
+
+// Merge two slices of strings, using the interleaving in from2.
+func mergestring(x, y []string, from2 []bool) []string {
+
+	if len(from2) != len(x)+len(y) {
+		panic("mergestring: length error")
+	}
+
+	z := make([]string, len(from2))
+	var i, j int
+	for k, f := range from2 {
+		if f {
+			z[k] = y[j]
+			j++
+		} else {
+			z[k] = x[i]
+			i++
+		}
+	}
+
+	return z
+}
+
+// Merge the data in one file of a staged bucket into the
+// corresponding file of an existing bucket.  The merged data
+// replace the existing file once they are complete, and the existing
+// file is kept in the premerge directory until the bucket is merged.
+func mergefile(filename, stagename, dt string, from2 []bool) {
+
+	logger.Printf("Merging %s into %s", stagename, filename)
+
+	config.Backup(filename, "premerge")
+
+	var sum uint32
+	var cs *config.ColumnStats
+	switch dt {
+	case "uvarint":
+		b := mergeuint64(readuvarint(filename), readuvarint(stagename), from2)
+		sum = writeuvarint(filename, b)
+		cs = config.CodeStats(b)
+	case "string":
+		b := mergestring(readstring(filename), readstring(stagename), from2)
+		sum = writestring(filename, b)
+		cs = config.StringStats(b)
+	default:
+		w, ok := config.DTsize[dt]
+		if !ok {
+			log.Printf("Processing %s\nNo size information for dtype %s\n\n",
+				filename, dt)
+			os.Exit(1)
+		}
+		b := mergebytes(readbytes(filename), readbytes(stagename), from2, w)
+		sum = writebytes(filename, b)
+		cs = config.FixedStats(b, dt)
+	}
+
+	d, f := path.Split(filename)
+	config.SetChecksums(d, map[string]uint32{f: sum})
+	vn := strings.TrimSuffix(f, ".bin.sz")
+	config.SetStats(d, map[string]*config.ColumnStats{vn: cs})
+}
+
+// MergedPath returns the name that staged bucket data are given once
+// they have been merged into the existing bucket, before they are
+// removed.
+func MergedPath(stagename string) string {
+	return path.Clean(stagename) + ".merged"
+}
+
+// Sort the staged data for one bucket and merge it into the
+// existing sorted bucket.
+func mergedir(dirname, stagename string) {
+
+	defer func() { <-sem }()
+
+	_, err := os.Stat(stagename)
+	if os.IsNotExist(err) {
+		logger.Printf("No staged data for %s", dirname)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	logger.Printf("Starting merge of %s into %s", stagename, dirname)
+
+	// Staged factorized variables must already have been coded
+	// with factorize append.
+	dtypes := getdtypes(dirname)
+	stypes := getdtypes(stagename)
+	if len(dtypes) != len(stypes) {
+		msg := fmt.Sprintf("%s and %s have different variables", dirname, stagename)
+		panic(msg)
+	}
+	for vn, dt := range dtypes {
+		if stypes[vn] != dt {
+			msg := fmt.Sprintf("Variable %s has dtype %s in %s and dtype %s in %s\n",
+				vn, dt, dirname, stypes[vn], stagename)
+			panic(msg)
+		}
+	}
+
+	sortdir(stagename)
+
+	from2, n := mergeorder(dirname, stagename)
+	if n == 0 {
+		err = os.RemoveAll(stagename)
+		if err != nil {
+			panic(err)
+		}
+		logger.Printf("Merged %d rows into %s", n, dirname)
+		return
+	}
+
+	// Until the staged data are removed, the bucket can be
+	// restored from the premerge directory with the recover tool.
+	config.StartPending(dirname, "sortbuckets append", "premerge")
+
+	// The backups made when the bucket was sorted do not have the
+	// appended rows, so the sorting can no longer be reverted.
+	err = os.RemoveAll(path.Join(dirname, "orig"))
+	if err != nil {
+		panic(err)
+	}
+
+	for vn, dt := range dtypes {
+		fn := path.Join(dirname, vn+".bin.sz")
+		sn := path.Join(stagename, vn+".bin.sz")
+		mergefile(fn, sn, dt, from2)
+	}
+
+	// The merge is complete once the staged data are moved away.
+	err = os.Rename(stagename, MergedPath(stagename))
+	if err != nil {
+		panic(err)
+	}
+	err = os.RemoveAll(MergedPath(stagename))
+	if err != nil {
+		panic(err)
+	}
+	config.FinishPending(dirname)
+	err = os.RemoveAll(path.Join(dirname, "premerge"))
+	if err != nil {
+		panic(err)
+	}
+
+	logger.Printf("Merged %d rows into %s", n, dirname)
+}
+
+// Append sorts the data in the staging area of each bucket, then
+// merges it into the bucket.  The existing buckets must already be
+// sorted using the same id and time variables.
+func Append(cnf *config.Config, id, time string, lgr *log.Logger) {
+
+	conf = cnf
+	logger = lgr
+
+	idvar = id
+	timevar = time
+
+	checkpending(config.BucketPath)
+	checkpending(config.StagePath)
+
+	sem = make(chan bool, concurrency)
+
+	for k := 0; k < int(conf.NumBuckets); k++ {
+		dirname := config.BucketPath(k, conf)
+		stagename := config.StagePath(k, conf)
+		sem <- true
+		go mergedir(dirname, stagename)
+	}
+
+	for k := 0; k < concurrency; k++ {
+		sem <- true
+	}
+
+	// Remove the staging area if all the buckets were merged.
+	err := os.Remove(path.Join(conf.TargetDir, "Append"))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Printf("Unable to remove staging area: %v", err)
+	}
+
+	logger.Printf("Done")
+}
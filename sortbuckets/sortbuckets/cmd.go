@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/kshedden/gosascols/config"
 	"github.com/kshedden/gosascols/sortbuckets"
@@ -49,6 +51,12 @@ func revert() {
 			if err != nil {
 				panic(err)
 			}
+			// Only the column files have checksums.  The string
+			// backups of factorized variables have none, so that
+			// cleanbuckets can remove them.
+			if strings.HasSuffix(fn, ".bin.sz") && !strings.HasSuffix(fn, "_string.bin.sz") {
+				config.UpdateChecksum(tod)
+			}
 		}
 	}
 }
@@ -57,23 +65,39 @@ func main() {
 
 	if len(os.Args) != 5 {
 		_, _ = os.Stderr.WriteString("sortbuckets: wrong number of arguments, usage\n\n")
-		_, _ = os.Stderr.WriteString("    sortbuckets [run|revert] idvar timevar config.toml\n\n")
+		_, _ = os.Stderr.WriteString("    sortbuckets [run|revert|append] idvar timevar config.toml\n\n")
 		os.Exit(1)
 	}
 
 	conf = config.ReadConfig(os.Args[4])
+	config.MustLock(conf, "sortbuckets "+os.Args[1])
+	defer config.Unlock(conf)
 	setupLogger()
 	logger.Printf("Read configuration from %s", os.Args[4])
+	start := time.Now()
 
 	if os.Args[1] == "revert" {
 		logger.Printf("Reverting to unsorted state")
 		revert()
-		os.Exit(0)
+		config.UpdateManifest(conf, "sortbuckets", start, func(m *config.Manifest) {
+			m.SortKeys = nil
+		})
+		return
 	}
 
 	idvar := os.Args[2]
 	timevar := os.Args[3]
 
+	var keys []string
+	for _, v := range []string{idvar, timevar} {
+		if v != "" {
+			keys = append(keys, v)
+		}
+	}
+	setkeys := func(m *config.Manifest) {
+		m.SortKeys = keys
+	}
+
 	if idvar != "" {
 		logger.Printf("Sorting on id variable %s", idvar)
 	}
@@ -82,8 +106,17 @@ func main() {
 		logger.Printf("Sorting on time variable %s", timevar)
 	}
 
+	if os.Args[1] == "append" {
+		logger.Printf("Merging staged data into sorted buckets")
+		sortbuckets.Append(conf, idvar, timevar, logger)
+		config.UpdateManifest(conf, "sortbuckets", start, setkeys)
+		logger.Printf("All done, exiting")
+		return
+	}
+
 	dirname := path.Join(conf.TargetDir, "Buckets")
 	sortbuckets.Run(conf, idvar, timevar, dirname, logger)
+	config.UpdateManifest(conf, "sortbuckets", start, setkeys)
 
 	logger.Printf("All done, exiting")
 }
@@ -43,7 +43,7 @@ var (
 
 type drec struct {
 	enrolid uint64
-	date    uint16
+	date    int64
 	pos     int
 }
 
@@ -54,21 +54,57 @@ func (d dslice) Len() int {
 }
 
 func (d dslice) Less(i, j int) bool {
-	if d[i].enrolid < d[j].enrolid {
+	return d[i].less(d[j])
+}
+
+func (a drec) less(b drec) bool {
+	if a.enrolid < b.enrolid {
 		return true
 	}
-	if d[i].enrolid > d[j].enrolid {
+	if a.enrolid > b.enrolid {
 		return false
 	}
-	return d[i].date < d[j].date
+	return a.date < b.date
 }
 
 func (d dslice) Swap(i, j int) {
 	d[i], d[j] = d[j], d[i]
 }
 
-// Get the sorted order for a bucket based on the enrolid and date variables.
-func getorder(dirname string) []int {
+// Read one value of the time variable, which may have any integer
+// dtype, including date and datetime.
+func readtime(rdr io.Reader, dt string, buf []byte) (int64, error) {
+
+	w, ok := config.DTsize[dt]
+	if !ok {
+		msg := fmt.Sprintf("Time variable %s has unsupported dtype %s\n", timevar, dt)
+		panic(msg)
+	}
+
+	_, err := io.ReadFull(rdr, buf[0:w])
+	if err != nil {
+		return 0, err
+	}
+
+	switch dt {
+	case "uint8":
+		return int64(buf[0]), nil
+	case "uint16":
+		return int64(binary.LittleEndian.Uint16(buf)), nil
+	case "uint32":
+		return int64(binary.LittleEndian.Uint32(buf)), nil
+	case "int32", "date":
+		return int64(int32(binary.LittleEndian.Uint32(buf))), nil
+	case "uint64", "int64", "datetime":
+		return int64(binary.LittleEndian.Uint64(buf)), nil
+	}
+
+	msg := fmt.Sprintf("Time variable %s has unsupported dtype %s\n", timevar, dt)
+	panic(msg)
+}
+
+// Get the enrolid and date values for a bucket, in file order.
+func getkeys(dirname string) []drec {
 
 	var rdre, rdrs io.Reader
 
@@ -88,7 +124,9 @@ func getorder(dirname string) []int {
 		rdre = snappy.NewReader(fide)
 	}
 
+	var tdt string
 	if hastime {
+		tdt = getdtypes(dirname)[timevar]
 		fn := path.Join(dirname, timevar+".bin.sz")
 		fids, err := os.Open(fn)
 		if err != nil {
@@ -98,10 +136,11 @@ func getorder(dirname string) []int {
 	}
 
 	var dvec []drec
+	buf := make([]byte, 8)
 	for pos := 0; ; pos++ {
 
 		var x uint64
-		var y uint16
+		var y int64
 
 		if hasid {
 			err := binary.Read(rdre, binary.LittleEndian, &x)
@@ -113,7 +152,8 @@ func getorder(dirname string) []int {
 		}
 
 		if hastime {
-			err := binary.Read(rdrs, binary.LittleEndian, &y)
+			var err error
+			y, err = readtime(rdrs, tdt, buf)
 			if err == io.EOF {
 				break
 			} else if err != nil {
@@ -124,6 +164,13 @@ func getorder(dirname string) []int {
 		dvec = append(dvec, drec{x, y, pos})
 	}
 
+	return dvec
+}
+
+// Get the sorted order for a bucket based on the enrolid and date variables.
+func getorder(dirname string) []int {
+
+	dvec := getkeys(dirname)
 	sort.Sort(dslice(dvec))
 
 	ii := make([]int, len(dvec))
@@ -169,6 +216,23 @@ func reorderuint64(x []uint64, ii []int) []uint64 {
 	return y
 }
 
+// Reorder a slice of strings, using the indices in ii.
+func reorderstring(x []string, ii []int) []string {
+
+	if len(ii) != len(x) {
+		print(fmt.Sprintf("%d != %d\n", len(x), len(ii)))
+		panic("reorderstring: length error")
+	}
+
+	n := len(x)
+	y := make([]string, n)
+	for i := 0; i < n; i++ {
+		y[i] = x[ii[i]]
+	}
+
+	return y
+}
+
 func readbytes(fname string) []byte {
 	fid, err := os.Open(fname)
 	if err != nil {
@@ -206,6 +270,88 @@ func readuvarint(fname string) []uint64 {
 	return b
 }
 
+func readstring(fname string) []string {
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	rdr := snappy.NewReader(fid)
+
+	var b []string
+	scanner := bufio.NewScanner(rdr)
+	for scanner.Scan() {
+		b = append(b, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// writecolumn replaces a column file with the data written by the
+// function wr, returning the checksum of the data.  The file is only
+// replaced once all of the data are written.
+func writecolumn(fname string, wr func(io.Writer) error) uint32 {
+	fid, err := config.CreateAtomic(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Abort()
+	wtr := snappy.NewBufferedWriter(fid)
+	cw := &config.ChecksumWriter{W: wtr}
+	if err := wr(cw); err != nil {
+		panic(err)
+	}
+	if err := wtr.Close(); err != nil {
+		panic(err)
+	}
+	if err := fid.Commit(); err != nil {
+		panic(err)
+	}
+	return cw.Sum
+}
+
+// Write fixed-width data to a file, returning its checksum.
+func writebytes(fname string, b []byte) uint32 {
+	return writecolumn(fname, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// Write uvarint data to a file, returning its checksum.
+func writeuvarint(fname string, b []uint64) uint32 {
+	return writecolumn(fname, func(w io.Writer) error {
+		buf := make([]byte, 8)
+		for _, x := range b {
+			m := binary.PutUvarint(buf, x)
+			if _, err := w.Write(buf[0:m]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Write newline-delimited string data to a file, returning its
+// checksum.
+func writestring(fname string, b []string) uint32 {
+	return writecolumn(fname, func(w io.Writer) error {
+		nl := []byte("\n")
+		for _, x := range b {
+			if _, err := io.WriteString(w, x); err != nil {
+				return err
+			}
+			if _, err := w.Write(nl); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Reorder the fixed-width data in one file.
 func dofixedwidth(filename string, ii []int, w int) {
 
@@ -216,29 +362,16 @@ func dofixedwidth(filename string, ii []int, w int) {
 
 	logger.Printf("Starting file %s", filename)
 
-	d, f := path.Split(filename)
-	bname := path.Join(d, "orig", f)
-	logger.Printf("Renaming %s -> %s\n", filename, bname)
-	err := os.Rename(filename, bname)
-	if err != nil {
-		panic(err)
-	}
+	// The original file is kept in the backup directory
+	config.Backup(filename, "orig")
 
-	b := readbytes(bname)
+	b := readbytes(filename)
 	b = reorderbytes(b, ii, w)
 
 	// Save the reordered data
-	fid, err := os.Create(filename)
-	if err != nil {
-		panic(err)
-	}
-	defer fid.Close()
-	wtr := snappy.NewBufferedWriter(fid)
-	defer wtr.Close()
-	_, err = wtr.Write(b)
-	if err != nil {
-		panic(err)
-	}
+	sum := writebytes(filename, b)
+	d, f := path.Split(filename)
+	config.SetChecksums(d, map[string]uint32{f: sum})
 
 	logger.Printf("Finishing file %s", filename)
 }
@@ -253,34 +386,57 @@ func dovarwidth(filename string, ii []int) {
 
 	logger.Printf("Starting file %s", filename)
 
-	d, f := path.Split(filename)
-	bname := path.Join(d, "orig", f)
-	logger.Printf("Renaming %s -> %s\n", filename, bname)
-	err := os.Rename(filename, bname)
-	if err != nil {
-		panic(err)
-	}
+	// The original file is kept in the backup directory
+	config.Backup(filename, "orig")
 
-	b := readuvarint(bname)
+	b := readuvarint(filename)
 	b = reorderuint64(b, ii)
 
 	// Save the reordered data
-	fid, err := os.Create(filename)
-	if err != nil {
-		panic(err)
-	}
-	defer fid.Close()
-	wtr := snappy.NewBufferedWriter(fid)
-	defer wtr.Close()
-	buf := make([]byte, 8)
-	for _, x := range b {
-		m := binary.PutUvarint(buf, x)
-		_, err = wtr.Write(buf[0:m])
-		if err != nil {
-			panic(err)
-		}
+	sum := writeuvarint(filename, b)
+	d, f := path.Split(filename)
+	config.SetChecksums(d, map[string]uint32{f: sum})
+
+	logger.Printf("Finishing file %s", filename)
+}
+
+// Reorder newline-delimited string data in one file.
+func dostring(filename string, ii []int) {
+
+	if strings.HasSuffix(filename, "_string.bin.sz") {
+		logger.Printf("Skipping %s", filename)
+		return
 	}
 
+	logger.Printf("Starting file %s", filename)
+
+	// The original file is kept in the backup directory
+	config.Backup(filename, "orig")
+
+	b := readstring(filename)
+	b = reorderstring(b, ii)
+
+	// Save the reordered data
+	sum := writestring(filename, b)
+	d, f := path.Split(filename)
+	config.SetChecksums(d, map[string]uint32{f: sum})
+
+	logger.Printf("Finishing file %s", filename)
+}
+
+// Reorder the backup of the original string values of a factorized
+// variable, so that it stays in the same order as the codes and
+// factorize revert can restore it.  The backups have no checksums.
+func dostringbackup(filename string, ii []int) {
+
+	logger.Printf("Starting file %s", filename)
+
+	config.Backup(filename, "orig")
+
+	b := readstring(filename)
+	b = reorderstring(b, ii)
+	writestring(filename, b)
+
 	logger.Printf("Finishing file %s", filename)
 }
 
@@ -289,17 +445,26 @@ func dodir(dirname string) {
 
 	defer func() { <-sem }()
 
+	sortdir(dirname)
+}
+
+// Reorder all files in a directory.
+func sortdir(dirname string) {
+
 	logger.Printf("Starting directory %s", dirname)
 
 	ii := getorder(dirname)
 
 	dtypes := getdtypes(dirname)
 
-	// Original files are placed in this directory as backups
-	err := os.MkdirAll(path.Join(dirname, "orig"), 0755)
-	if err != nil {
-		panic(err)
-	}
+	// Original files are placed in the orig directory as backups.
+	// Until the sort is finished, the bucket can be restored from
+	// the backups with the recover tool.
+	config.StartPending(dirname, "sortbuckets", "orig")
+
+	// The dtypes are kept with the backups, so that factorize
+	// revert can tell which backups hold codes.
+	config.Backup(path.Join(dirname, "dtypes.json"), "orig")
 
 	for vn, dt := range dtypes {
 
@@ -307,6 +472,8 @@ func dodir(dirname string) {
 
 		if dt == "uvarint" {
 			dovarwidth(fn, ii)
+		} else if dt == "string" {
+			dostring(fn, ii)
 		} else {
 			w, ok := config.DTsize[dt]
 			if !ok {
@@ -316,8 +483,15 @@ func dodir(dirname string) {
 			}
 			dofixedwidth(fn, ii, w)
 		}
+
+		sn := path.Join(dirname, vn+"_string.bin.sz")
+		if _, err := os.Stat(sn); dt == "uvarint" && err == nil {
+			dostringbackup(sn, ii)
+		}
 	}
 
+	config.FinishPending(dirname)
+
 	logger.Printf("Finishing directory %s", dirname)
 }
 
@@ -336,6 +510,18 @@ func getdtypes(dirname string) map[string]string {
 	return dtypes
 }
 
+// checkpending panics if an earlier operation on any of the buckets
+// did not finish, before any bucket is changed.  The bucket
+// directories are given by dir.
+func checkpending(dir func(int, *config.Config) string) {
+	for k := 0; k < int(conf.NumBuckets); k++ {
+		if p := config.ReadPending(dir(k, conf)); p != nil {
+			msg := fmt.Sprintf("%s in %s did not finish, run the recover tool first\n", p.Command, dir(k, conf))
+			panic(msg)
+		}
+	}
+}
+
 func Run(cnf *config.Config, id, time, dirname string, lgr *log.Logger) {
 
 	conf = cnf
@@ -344,6 +530,8 @@ func Run(cnf *config.Config, id, time, dirname string, lgr *log.Logger) {
 	idvar = id
 	timevar = time
 
+	checkpending(config.BucketPath)
+
 	sem = make(chan bool, concurrency)
 
 	for k := 0; k < int(conf.NumBuckets); k++ {
@@ -1,19 +1,59 @@
 /*
 Remove all temporary files from the bucket directories.
+
+The backups removed by cleanbuckets are needed by the recover tool to
+repair a bucket after an interrupted command, so nothing is removed
+if any bucket needs to be repaired.
 */
 
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
 
-	"github.com/kshedden/goclaims/config"
+	"github.com/kshedden/gosascols/config"
 )
 
+// needsrecover returns a description of the unfinished operation in a
+// bucket directory whose backups are needed by the recover tool, or
+// an empty string if there is none.
+func needsrecover(dir string) string {
+
+	if p := config.ReadPending(dir); p != nil {
+		return fmt.Sprintf("%s did not finish", p.Command)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "dtypes.json")); os.IsNotExist(err) {
+		return "dtypes.json is missing"
+	}
+
+	// A column that is still a string column while its string
+	// values are backed up may be partly factorized.
+	fid, err := os.Open(path.Join(dir, "dtypes.json"))
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	dtypes := make(map[string]string)
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(&dtypes)
+	if err != nil {
+		panic(err)
+	}
+	for vn, dt := range dtypes {
+		if _, err := os.Stat(path.Join(dir, vn+"_string.bin.sz")); dt == "string" && err == nil {
+			return fmt.Sprintf("the factorization of %s did not finish", vn)
+		}
+	}
+
+	return ""
+}
+
 func main() {
 
 	if len(os.Args) != 2 {
@@ -22,6 +62,19 @@ func main() {
 	}
 
 	conf := config.ReadConfig(os.Args[1])
+	config.MustLock(conf, "cleanbuckets")
+	defer config.Unlock(conf)
+
+	// Check all of the buckets before removing anything.
+	for k := 0; k < int(conf.NumBuckets); k++ {
+		px := config.BucketPath(k, conf)
+		if msg := needsrecover(px); msg != "" {
+			os.Stderr.WriteString(fmt.Sprintf("cleanbuckets: in %s, %s\n", px, msg))
+			os.Stderr.WriteString("Run the recover tool before running cleanbuckets\n")
+			config.Unlock(conf)
+			os.Exit(1)
+		}
+	}
 
 	nf := 0
 	nd := 0
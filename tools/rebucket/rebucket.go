@@ -0,0 +1,397 @@
+/*
+Copy a bucketed dataset into a new dataset with a different number of
+buckets, or a different hash function, without re-reading the SAS
+files.
+
+Usage:
+
+    rebucket idvar timevar old.toml new.toml
+
+The rows of old.toml's dataset are redistributed according to the
+NumBuckets and Hash settings in new.toml, using the values of idvar.
+The dtypes and factor codes are preserved, and the new buckets are
+sorted by idvar and timevar.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/kshedden/gosascols/config"
+	"github.com/kshedden/gosascols/sortbuckets"
+)
+
+const (
+	concurrency = 10
+)
+
+var (
+	oldconf *config.Config
+	newconf *config.Config
+
+	// Name of the identifier variable
+	idvar string
+
+	// The dtypes of the dataset, the same in every bucket
+	dtypes map[string]string
+
+	// Locks for the new buckets
+	muts []sync.Mutex
+
+	logger *log.Logger
+
+	// Semaphore to limit concurrency
+	sem chan bool
+)
+
+func setupLogger() {
+
+	fn := "rebucket_" + path.Base(newconf.TargetDir) + ".log"
+	fid, err := os.Create(fn)
+	if err != nil {
+		panic(err)
+	}
+
+	logger = log.New(fid, "", log.Ltime)
+}
+
+func readbytes(fname string) []byte {
+	fid, err := os.Open(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	rdr := snappy.NewReader(fid)
+	b, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// readkeys returns the values of the id variable in one bucket.
+func readkeys(dirname string) []uint64 {
+
+	b := readbytes(path.Join(dirname, idvar+".bin.sz"))
+
+	x := make([]uint64, len(b)/8)
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint64(b[8*i : 8*i+8])
+	}
+
+	return x
+}
+
+// split divides the raw column data in b into rows, returning the
+// encoded bytes of each row in the same order as they appear in b.
+func split(b []byte, dt string) [][]byte {
+
+	var rows [][]byte
+
+	switch dt {
+	case "uvarint":
+		for len(b) > 0 {
+			_, m := binary.Uvarint(b)
+			if m <= 0 {
+				panic("split: invalid uvarint data")
+			}
+			rows = append(rows, b[0:m])
+			b = b[m:]
+		}
+	case "string":
+		for len(b) > 0 {
+			m := bytes.IndexByte(b, '\n')
+			if m < 0 {
+				panic("split: unterminated string data")
+			}
+			rows = append(rows, b[0:m+1])
+			b = b[m+1:]
+		}
+	default:
+		w, ok := config.DTsize[dt]
+		if !ok {
+			msg := fmt.Sprintf("No size information for dtype %s\n", dt)
+			panic(msg)
+		}
+		for len(b) > 0 {
+			rows = append(rows, b[0:w])
+			b = b[w:]
+		}
+	}
+
+	return rows
+}
+
+// appendfile appends snappy compressed data to a file in a new bucket.
+func appendfile(fname string, b []byte) {
+
+	fid, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	wtr := snappy.NewBufferedWriter(fid)
+	_, err = wtr.Write(b)
+	if err != nil {
+		panic(err)
+	}
+	err = wtr.Close()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// dobucket redistributes the rows of one bucket of the old dataset
+// into the buckets of the new dataset.
+func dobucket(k int) {
+
+	defer func() { <-sem }()
+
+	dirname := config.BucketPath(k, oldconf)
+	logger.Printf("Starting bucket %s", dirname)
+
+	keys := readkeys(dirname)
+	target := make([]int, len(keys))
+	for i, x := range keys {
+		target[i] = config.Bucket(x, newconf)
+	}
+
+	// The data for each variable, split by new bucket.
+	nb := int(newconf.NumBuckets)
+	parts := make(map[string][]bytes.Buffer)
+	for vn, dt := range dtypes {
+		rows := split(readbytes(path.Join(dirname, vn+".bin.sz")), dt)
+		if len(rows) != len(keys) {
+			msg := fmt.Sprintf("%s in %s has %d rows, %s has %d rows\n",
+				vn, dirname, len(rows), idvar, len(keys))
+			panic(msg)
+		}
+
+		bufs := make([]bytes.Buffer, nb)
+		for i, r := range rows {
+			bufs[target[i]].Write(r)
+		}
+		parts[vn] = bufs
+	}
+
+	// Each new bucket is locked while all of its variables are
+	// written, so that the rows stay aligned across variables.
+	for j := 0; j < nb; j++ {
+		if parts[idvar][j].Len() == 0 {
+			continue
+		}
+		muts[j].Lock()
+		outdir := config.BucketPath(j, newconf)
+		for vn := range dtypes {
+			appendfile(path.Join(outdir, vn+".bin.sz"), parts[vn][j].Bytes())
+		}
+		muts[j].Unlock()
+	}
+
+	logger.Printf("Finishing bucket %s", dirname)
+}
+
+// dostats records the statistics of the columns in one bucket of the
+// new dataset.
+func dostats(k int) {
+
+	defer func() { <-sem }()
+
+	dirname := config.BucketPath(k, newconf)
+	for vn, dt := range dtypes {
+		config.UpdateStats(path.Join(dirname, vn+".bin.sz"), dt)
+	}
+}
+
+// copyfile copies a file in the top level of the old dataset to the
+// new dataset, if it exists.
+func copyfile(name string) {
+
+	src, err := os.Open(path.Join(oldconf.TargetDir, name))
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		panic(err)
+	}
+	defer src.Close()
+
+	dst, err := os.Create(path.Join(newconf.TargetDir, name))
+	if err != nil {
+		panic(err)
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// writeconfig writes the configuration information for the new dataset.
+func writeconfig() {
+
+	type Config struct {
+		NumBuckets  uint32
+		Compression string
+		CodesDir    string
+		Hash        string
+	}
+
+	c := Config{NumBuckets: newconf.NumBuckets, Compression: "snappy",
+		CodesDir: newconf.CodesDir, Hash: newconf.Hash}
+
+	fid, err := os.Create(path.Join(newconf.TargetDir, "conf.json"))
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	enc := json.NewEncoder(fid)
+	err = enc.Encode(c)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// setup checks that every bucket of the old dataset has the same
+// dtypes, and creates the empty buckets of the new dataset.  Every
+// bucket has a file for each variable, including buckets that do not
+// receive any rows.
+func setup() {
+
+	dtypes = config.ReadDtypes(0, oldconf)
+	for k := 1; k < int(oldconf.NumBuckets); k++ {
+		dt := config.ReadDtypes(k, oldconf)
+		if len(dt) != len(dtypes) {
+			msg := fmt.Sprintf("Bucket %d has %d variables, bucket 0 has %d variables\n",
+				k, len(dt), len(dtypes))
+			panic(msg)
+		}
+		for vn, t := range dt {
+			if dtypes[vn] != t {
+				msg := fmt.Sprintf("Variable %s has dtype %s in bucket %d, %s in bucket 0\n",
+					vn, t, k, dtypes[vn])
+				panic(msg)
+			}
+		}
+	}
+
+	if _, ok := dtypes[idvar]; !ok {
+		msg := fmt.Sprintf("Id variable %s not found\n", idvar)
+		panic(msg)
+	}
+
+	dtb, err := json.Marshal(dtypes)
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.RemoveAll(path.Join(newconf.TargetDir, "Buckets"))
+	if err != nil {
+		panic(err)
+	}
+
+	for k := 0; k < int(newconf.NumBuckets); k++ {
+		dn := config.BucketPath(k, newconf)
+		err = os.MkdirAll(dn, 0755)
+		if err != nil {
+			panic(err)
+		}
+		err = ioutil.WriteFile(path.Join(dn, "dtypes.json"), dtb, 0644)
+		if err != nil {
+			panic(err)
+		}
+		for vn := range dtypes {
+			appendfile(path.Join(dn, vn+".bin.sz"), nil)
+		}
+	}
+
+	writeconfig()
+	copyfile("CodeGroups.json")
+}
+
+func main() {
+
+	if len(os.Args) != 5 {
+		os.Stderr.WriteString("rebucket: wrong number of arguments, usage\n\n")
+		os.Stderr.WriteString("    rebucket idvar timevar old.toml new.toml\n\n")
+		os.Exit(1)
+	}
+
+	idvar = os.Args[1]
+	timevar := os.Args[2]
+	oldconf = config.ReadConfig(os.Args[3])
+	newconf = config.ReadConfig(os.Args[4])
+
+	if path.Clean(oldconf.TargetDir) == path.Clean(newconf.TargetDir) {
+		os.Stderr.WriteString("rebucket: the old and new datasets must have different TargetDir\n\n")
+		os.Exit(1)
+	}
+
+	// The old dataset is locked so that it does not change while
+	// it is being read.
+	config.MustLock(oldconf, "rebucket")
+	defer config.Unlock(oldconf)
+	if err := config.Lock(newconf, "rebucket"); err != nil {
+		config.Unlock(oldconf)
+		os.Stderr.WriteString(fmt.Sprintf("rebucket: %v\n", err))
+		os.Exit(1)
+	}
+	defer config.Unlock(newconf)
+
+	setupLogger()
+	start := time.Now()
+	logger.Printf("Rebucketing %s (%d buckets) into %s (%d buckets, hash %s)",
+		oldconf.TargetDir, oldconf.NumBuckets, newconf.TargetDir, newconf.NumBuckets, newconf.Hash)
+
+	setup()
+
+	muts = make([]sync.Mutex, newconf.NumBuckets)
+	sem = make(chan bool, concurrency)
+	for k := 0; k < int(oldconf.NumBuckets); k++ {
+		sem <- true
+		go dobucket(k)
+	}
+	for k := 0; k < concurrency; k++ {
+		sem <- true
+	}
+	logger.Printf("Done redistributing rows, sorting")
+
+	dirname := path.Join(newconf.TargetDir, "Buckets")
+	sortbuckets.Run(newconf, idvar, timevar, dirname, logger)
+
+	logger.Printf("Computing column statistics")
+	sem = make(chan bool, concurrency)
+	for k := 0; k < int(newconf.NumBuckets); k++ {
+		sem <- true
+		go dostats(k)
+	}
+	for k := 0; k < concurrency; k++ {
+		sem <- true
+	}
+
+	// The new dataset has the provenance of the old dataset.
+	oldman := config.ReadManifest(oldconf)
+	config.UpdateManifest(newconf, "rebucket", start, func(m *config.Manifest) {
+		*m = config.Manifest{Sources: oldman.Sources, Stages: oldman.Stages}
+		for _, v := range []string{idvar, timevar} {
+			if v != "" {
+				m.SortKeys = append(m.SortKeys, v)
+			}
+		}
+	})
+
+	logger.Printf("All done, exiting")
+}
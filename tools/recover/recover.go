@@ -0,0 +1,289 @@
+/*
+Repair the buckets of a dataset after a factorize or sortbuckets
+command was interrupted.
+
+Usage:
+
+    recover [-n] config.toml
+
+Each bucket, and each bucket of the staging area for appended data,
+is checked for:
+
+  - temporary files left by an interrupted write, which are removed
+
+  - a missing dtypes.json file, which is restored from dtypes_string.json
+
+  - an unfinished sort or append merge, in which case the column files
+    are restored from the backups made at the start of the operation
+    (or the operation is completed, if it only remained to remove the
+    staged data)
+
+  - an unfinished factorization, meaning a column with a backup of its
+    string values while dtypes.json still has it as a string, in which
+    case the string values are restored
+
+The repairs are reported on stdout.  With -n, the problems are
+reported but not repaired.  Once the buckets are repaired, the
+interrupted command can be run again.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/kshedden/gosascols/config"
+	"github.com/kshedden/gosascols/sortbuckets"
+)
+
+var (
+	conf *config.Config
+
+	// If true, only report the problems
+	dryrun bool
+
+	// Number of problems found
+	nfound int
+)
+
+func report(msg string, args ...interface{}) {
+	nfound++
+	fmt.Printf(msg+"\n", args...)
+}
+
+func readdtypes(fname string) map[string]string {
+
+	fid, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	dtypes := make(map[string]string)
+	dec := json.NewDecoder(fid)
+	err = dec.Decode(&dtypes)
+	if err != nil {
+		panic(err)
+	}
+
+	return dtypes
+}
+
+// restore replaces a column file with its backup, and records the
+// checksum and statistics of the restored file.  The string backups
+// of factorized columns (with no dtype) have no checksums or
+// statistics.
+func restore(bname, fname, dt string) {
+
+	err := os.Rename(bname, fname)
+	if err != nil {
+		panic(err)
+	}
+
+	// If the backup is a hard link to the file, the rename does
+	// nothing.
+	err = os.Remove(bname)
+	if err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+
+	if dt != "" {
+		config.UpdateChecksum(fname)
+		config.UpdateStats(fname, dt)
+	}
+}
+
+// cleantemp removes the temporary files in a bucket directory.
+func cleantemp(dir string) {
+
+	fl, err := ioutil.ReadDir(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, f := range fl {
+		if config.IsTempFile(f.Name()) {
+			fn := path.Join(dir, f.Name())
+			report("%s: temporary file", fn)
+			if !dryrun {
+				err := os.Remove(fn)
+				if err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+}
+
+// fixdtypes restores a missing dtypes.json file.
+func fixdtypes(dir string) {
+
+	fn := path.Join(dir, "dtypes.json")
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		return
+	}
+
+	sn := path.Join(dir, "dtypes_string.json")
+	if _, err := os.Stat(sn); err != nil {
+		msg := fmt.Sprintf("%s and %s are both missing, the bucket cannot be repaired\n", fn, sn)
+		panic(msg)
+	}
+
+	report("%s: missing, restoring from %s", fn, sn)
+	if !dryrun {
+		config.WriteJSON(fn, readdtypes(sn))
+	}
+}
+
+// fixpending undoes or completes an unfinished sort or append merge.
+func fixpending(dir, stagedir string) {
+
+	p := config.ReadPending(dir)
+	if p == nil {
+		return
+	}
+
+	bdir := path.Join(dir, p.Backup)
+
+	// The merge of staged data is complete once the staged data
+	// have been moved away.
+	if p.Command == "sortbuckets append" && stagedir != "" {
+		if _, err := os.Stat(stagedir); os.IsNotExist(err) {
+			report("%s: %s finished, removing its backups", dir, p.Command)
+			if !dryrun {
+				config.FinishPending(dir)
+				for _, d := range []string{sortbuckets.MergedPath(stagedir), bdir} {
+					if err := os.RemoveAll(d); err != nil {
+						panic(err)
+					}
+				}
+			}
+			return
+		}
+	}
+
+	report("%s: %s started %s did not finish, restoring from %s", dir, p.Command,
+		p.Start.Format("2006-01-02 15:04:05"), bdir)
+	if dryrun {
+		return
+	}
+
+	fl, err := ioutil.ReadDir(bdir)
+	if err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+
+	// The dtypes are restored first, since they give the types of
+	// the restored columns.
+	for _, f := range fl {
+		if fn := f.Name(); !strings.HasSuffix(fn, ".bin.sz") {
+			err := os.Rename(path.Join(bdir, fn), path.Join(dir, fn))
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	dtypes := readdtypes(path.Join(dir, "dtypes.json"))
+	for _, f := range fl {
+		if fn := f.Name(); strings.HasSuffix(fn, ".bin.sz") {
+			vn := strings.TrimSuffix(fn, ".bin.sz")
+			if strings.HasSuffix(vn, "_string") {
+				restore(path.Join(bdir, fn), path.Join(dir, fn), "")
+			} else {
+				restore(path.Join(bdir, fn), path.Join(dir, fn), dtypes[vn])
+			}
+		}
+	}
+
+	config.FinishPending(dir)
+	err = os.RemoveAll(bdir)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// fixfactorize restores the string values of columns that were being
+// factorized.  The dtypes are only changed once all of the columns in
+// a bucket are factorized, so a column whose string values are backed
+// up but that is still a string column in dtypes.json may have been
+// partly converted.
+func fixfactorize(dir string) {
+
+	dtypes := readdtypes(path.Join(dir, "dtypes.json"))
+
+	fl, err := ioutil.ReadDir(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, f := range fl {
+		sn := f.Name()
+		if !strings.HasSuffix(sn, "_string.bin.sz") {
+			continue
+		}
+		vn := strings.TrimSuffix(sn, "_string.bin.sz")
+		if dtypes[vn] != "string" {
+			continue
+		}
+
+		fn := path.Join(dir, vn+".bin.sz")
+		report("%s: factorization did not finish, restoring from %s", fn, sn)
+		if !dryrun {
+			restore(path.Join(dir, sn), fn, "string")
+		}
+	}
+}
+
+func dobucket(dir, stagedir string) {
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return
+	}
+
+	cleantemp(dir)
+	fixdtypes(dir)
+	fixpending(dir, stagedir)
+	fixfactorize(dir)
+}
+
+func main() {
+
+	if len(os.Args) == 3 && os.Args[1] == "-n" {
+		dryrun = true
+		os.Args = append(os.Args[0:1], os.Args[2:]...)
+	}
+
+	if len(os.Args) != 2 {
+		os.Stderr.WriteString("recover: wrong number of arguments, usage\n\n")
+		os.Stderr.WriteString("    recover [-n] config.toml\n\n")
+		os.Exit(1)
+	}
+
+	conf = config.ReadConfig(os.Args[1])
+	config.MustLock(conf, "recover")
+	defer config.Unlock(conf)
+
+	for k := 0; k < int(conf.NumBuckets); k++ {
+		dobucket(config.BucketPath(k, conf), config.StagePath(k, conf))
+		dobucket(config.StagePath(k, conf), "")
+	}
+
+	var msg string
+	switch {
+	case nfound == 0:
+		msg = "No problems found\n"
+	case dryrun:
+		msg = fmt.Sprintf("Found %d problems, run without -n to repair them\n", nfound)
+	default:
+		msg = fmt.Sprintf("Repaired %d problems\n", nfound)
+	}
+	os.Stdout.WriteString(msg)
+}
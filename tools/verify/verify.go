@@ -0,0 +1,117 @@
+/*
+Check the column files in every bucket against the checksums recorded
+when they were written.
+
+Usage:
+
+    verify config.toml
+
+Mismatched checksums, missing files, and column files with no recorded
+checksum are reported on stdout.  The exit status is 1 if any
+mismatched or missing files were found.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/kshedden/gosascols/config"
+)
+
+var (
+	conf *config.Config
+
+	// Problems found in each bucket
+	problems [][]string
+
+	// Number of files checked and number of files with errors
+	nchecked int
+	nbad     int
+	mut      sync.Mutex
+)
+
+// dobucket verifies the files in one bucket.
+func dobucket(k int, sem chan bool) {
+
+	defer func() { <-sem }()
+
+	dir := config.BucketPath(k, conf)
+	sums := config.ReadChecksums(dir)
+
+	var fnames []string
+	for fn := range sums {
+		fnames = append(fnames, fn)
+	}
+	sort.Strings(fnames)
+
+	var msgs []string
+	var bad int
+	for _, fn := range fnames {
+		s, err := config.FileChecksum(path.Join(dir, fn))
+		if os.IsNotExist(err) {
+			msgs = append(msgs, fmt.Sprintf("%s: missing", path.Join(dir, fn)))
+			bad++
+		} else if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s: %v", path.Join(dir, fn), err))
+			bad++
+		} else if s != sums[fn] {
+			msgs = append(msgs, fmt.Sprintf("%s: checksum %08x, expected %08x",
+				path.Join(dir, fn), s, sums[fn]))
+			bad++
+		}
+	}
+
+	// Column files that were written before checksums were
+	// recorded are reported, but are not errors.
+	for vn := range config.ReadDtypes(k, conf) {
+		fn := vn + ".bin.sz"
+		if _, ok := sums[fn]; !ok {
+			msgs = append(msgs, fmt.Sprintf("%s: no checksum", path.Join(dir, fn)))
+		}
+	}
+
+	problems[k] = msgs
+	mut.Lock()
+	nchecked += len(fnames)
+	nbad += bad
+	mut.Unlock()
+}
+
+func main() {
+
+	if len(os.Args) != 2 {
+		os.Stderr.WriteString("verify: wrong number of arguments, usage\n\n")
+		os.Stderr.WriteString("    verify config.toml\n\n")
+		os.Exit(1)
+	}
+
+	conf = config.ReadConfig(os.Args[1])
+
+	problems = make([][]string, conf.NumBuckets)
+	sem := make(chan bool, conf.Concurrency)
+	for k := 0; k < int(conf.NumBuckets); k++ {
+		sem <- true
+		go dobucket(k, sem)
+	}
+	for k := 0; k < conf.Concurrency; k++ {
+		sem <- true
+	}
+
+	for _, msgs := range problems {
+		for _, m := range msgs {
+			fmt.Println(m)
+		}
+	}
+
+	msg := fmt.Sprintf("Checked %d files, %d failed\n", nchecked, nbad)
+	os.Stdout.WriteString(msg)
+
+	if nbad > 0 {
+		os.Exit(1)
+	}
+}